@@ -0,0 +1,332 @@
+package downloads
+
+import (
+	"bufio"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// Credentials authenticate the requests of a download. They are applied to
+// every request, including resumed and ranged ones, and are never saved
+// with the task state.
+type Credentials interface {
+	// Authorize sets the credentials of req. unauthorized is the 401
+	// response to the previous attempt of req, nil on the first attempt.
+	// After a 401 the request is only sent again when Authorize returns
+	// true.
+	Authorize(req *http.Request, unauthorized *http.Response) (bool, error)
+}
+
+type basicAuth struct {
+	user, password string
+}
+
+// BasicAuth returns credentials sending user and password with every
+// request.
+func BasicAuth(user, password string) Credentials {
+	return basicAuth{user: user, password: password}
+}
+
+func (a basicAuth) Authorize(req *http.Request, unauthorized *http.Response) (bool, error) {
+	if unauthorized != nil {
+		return false, nil
+	}
+	req.SetBasicAuth(a.user, a.password)
+	return true, nil
+}
+
+type bearerToken string
+
+// BearerToken returns credentials sending token with every request.
+func BearerToken(token string) Credentials {
+	return bearerToken(token)
+}
+
+func (t bearerToken) Authorize(req *http.Request, unauthorized *http.Response) (bool, error) {
+	if unauthorized != nil {
+		return false, nil
+	}
+	req.Header.Set("Authorization", "Bearer "+string(t))
+	return true, nil
+}
+
+// digestAuth answers Digest challenges, RFC 7616. The last challenge is
+// reused for the next requests so that only the first one is rejected.
+type digestAuth struct {
+	user, password string
+	mu             sync.Mutex
+	challenge      map[string]string
+	count          int
+}
+
+// DigestAuth returns credentials answering the Digest challenge of the
+// server with user and password.
+func DigestAuth(user, password string) Credentials {
+	return &digestAuth{user: user, password: password}
+}
+
+func (a *digestAuth) Authorize(req *http.Request, unauthorized *http.Response) (bool, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if unauthorized != nil {
+		challenge := findChallenge(unauthorized.Header.Values("WWW-Authenticate"), "digest")
+		if challenge == nil {
+			return false, nil
+		}
+		a.challenge, a.count = challenge, 0
+	}
+	if a.challenge == nil {
+		// Wait for the challenge of the server.
+		return true, nil
+	}
+	header, err := a.authorization(req)
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Authorization", header)
+	return true, nil
+}
+
+// authorization computes the Authorization header of req. a.mu must be held.
+func (a *digestAuth) authorization(req *http.Request) (string, error) {
+	c := a.challenge
+	algorithm := c["algorithm"]
+	var h func() hash.Hash
+	switch strings.ToUpper(strings.TrimSuffix(strings.ToLower(algorithm), "-sess")) {
+	case "", "MD5":
+		h = md5.New
+	case "SHA-256":
+		h = sha256.New
+	default:
+		return "", fmt.Errorf("unsupported digest algorithm %q", algorithm)
+	}
+	digest := func(parts ...string) string {
+		d := h()
+		d.Write([]byte(strings.Join(parts, ":")))
+		return hex.EncodeToString(d.Sum(nil))
+	}
+
+	b := make([]byte, 16)
+	rand.Read(b)
+	cnonce := hex.EncodeToString(b)
+	a.count++
+	nc := fmt.Sprintf("%08x", a.count)
+	uri := req.URL.RequestURI()
+
+	ha1 := digest(a.user, c["realm"], a.password)
+	if strings.HasSuffix(strings.ToLower(algorithm), "-sess") {
+		ha1 = digest(ha1, c["nonce"], cnonce)
+	}
+	ha2 := digest(req.Method, uri)
+	qop := ""
+	for _, q := range strings.Split(c["qop"], ",") {
+		if strings.TrimSpace(q) == "auth" {
+			qop = "auth"
+		}
+	}
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "Digest username=%q, realm=%q, nonce=%q, uri=%q", a.user, c["realm"], c["nonce"], uri)
+	if qop != "" {
+		fmt.Fprintf(&sb, ", qop=%s, nc=%s, cnonce=%q, response=%q", qop, nc, cnonce, digest(ha1, c["nonce"], nc, cnonce, qop, ha2))
+	} else {
+		fmt.Fprintf(&sb, ", response=%q", digest(ha1, c["nonce"], ha2))
+	}
+	if algorithm != "" {
+		fmt.Fprintf(&sb, ", algorithm=%s", algorithm)
+	}
+	if opaque, ok := c["opaque"]; ok {
+		fmt.Fprintf(&sb, ", opaque=%q", opaque)
+	}
+	return sb.String(), nil
+}
+
+// findChallenge returns the parameters of the first challenge of scheme in
+// the WWW-Authenticate headers, nil if there is none.
+func findChallenge(headers []string, scheme string) map[string]string {
+	for _, header := range headers {
+		s := header
+		for s != "" {
+			name, rest, _ := strings.Cut(strings.TrimLeft(s, " ,"), " ")
+			params, rest := parseAuthParams(rest)
+			if strings.EqualFold(strings.TrimSuffix(name, ","), scheme) {
+				return params
+			}
+			s = rest
+		}
+	}
+	return nil
+}
+
+// parseAuthParams parses the comma-separated name=value pairs of a
+// challenge. It stops at the next challenge and returns the rest of s.
+func parseAuthParams(s string) (map[string]string, string) {
+	params := map[string]string{}
+	for {
+		s = strings.TrimLeft(s, " ,")
+		eq := strings.IndexByte(s, '=')
+		if eq < 0 || strings.ContainsAny(s[:eq], " ,") {
+			return params, s
+		}
+		name := strings.ToLower(strings.TrimSpace(s[:eq]))
+		s = strings.TrimLeft(s[eq+1:], " ")
+		var value string
+		if strings.HasPrefix(s, `"`) {
+			var sb strings.Builder
+			i := 1
+			for ; i < len(s) && s[i] != '"'; i++ {
+				if s[i] == '\\' && i+1 < len(s) {
+					i++
+				}
+				sb.WriteByte(s[i])
+			}
+			value, s = sb.String(), s[min(i+1, len(s)):]
+		} else {
+			end := strings.IndexByte(s, ',')
+			if end < 0 {
+				end = len(s)
+			}
+			value, s = strings.TrimSpace(s[:end]), s[end:]
+		}
+		params[name] = value
+	}
+}
+
+// Netrc holds the credentials of a .netrc file. Requests are sent with the
+// login and password of the machine matching their host, or of the default
+// entry, using Basic authentication.
+type Netrc struct {
+	machines map[string]basicAuth
+	fallback *basicAuth
+}
+
+// LoadNetrc reads the file named by $NETRC, ~/.netrc by default.
+func LoadNetrc() (*Netrc, error) {
+	path := os.Getenv("NETRC")
+	if path == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, err
+		}
+		path = filepath.Join(home, ".netrc")
+	}
+	return ReadNetrc(path)
+}
+
+// ReadNetrc reads the .netrc file at path.
+func ReadNetrc(path string) (*Netrc, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseNetrc(string(data))
+}
+
+// ParseNetrc parses the content of a .netrc file.
+func ParseNetrc(data string) (*Netrc, error) {
+	n := &Netrc{machines: map[string]basicAuth{}}
+	var entry *basicAuth
+	var machine string
+	save := func() {
+		if entry == nil {
+			return
+		}
+		if machine == "" {
+			n.fallback = entry
+		} else if _, ok := n.machines[machine]; !ok {
+			n.machines[machine] = *entry
+		}
+	}
+	lines := bufio.NewScanner(strings.NewReader(data))
+	inMacro := false
+	for lines.Scan() {
+		line := lines.Text()
+		if inMacro {
+			// Macros end with an empty line.
+			inMacro = strings.TrimSpace(line) != ""
+			continue
+		}
+		fields := strings.Fields(line)
+		for i := 0; i < len(fields); i++ {
+			switch fields[i] {
+			case "machine", "default":
+				save()
+				entry, machine = &basicAuth{}, ""
+				if fields[i] == "machine" {
+					if i+1 >= len(fields) {
+						return nil, errors.New("netrc: machine without a name")
+					}
+					i++
+					machine = strings.ToLower(fields[i])
+				}
+			case "login", "password", "account":
+				if i+1 >= len(fields) {
+					return nil, fmt.Errorf("netrc: %s without a value", fields[i])
+				}
+				if entry == nil {
+					return nil, fmt.Errorf("netrc: %s outside of a machine", fields[i])
+				}
+				switch fields[i] {
+				case "login":
+					entry.user = fields[i+1]
+				case "password":
+					entry.password = fields[i+1]
+				}
+				i++
+			case "macdef":
+				save()
+				entry, inMacro = nil, true
+				i = len(fields)
+			default:
+				if strings.HasPrefix(fields[i], "#") {
+					i = len(fields)
+					continue
+				}
+				return nil, fmt.Errorf("netrc: unexpected %q", fields[i])
+			}
+		}
+	}
+	save()
+	return n, lines.Err()
+}
+
+// lookup returns the credentials of host, false if there are none.
+func (n *Netrc) lookup(host string) (basicAuth, bool) {
+	if a, ok := n.machines[strings.ToLower(host)]; ok {
+		return a, true
+	}
+	if n.fallback != nil {
+		return *n.fallback, true
+	}
+	return basicAuth{}, false
+}
+
+func (n *Netrc) Authorize(req *http.Request, unauthorized *http.Response) (bool, error) {
+	a, ok := n.lookup(req.URL.Hostname())
+	if !ok {
+		return false, nil
+	}
+	return a.Authorize(req, unauthorized)
+}
+
+// stripCredentials removes the user and password from rawURL so that it
+// can be saved.
+func stripCredentials(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.User == nil {
+		return rawURL
+	}
+	u.User = nil
+	return u.String()
+}
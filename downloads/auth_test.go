@@ -0,0 +1,185 @@
+package downloads
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newAuthServer serves content to the requests accepted by authorized and
+// records the Authorization header of every request.
+func newAuthServer(t *testing.T, content []byte, authorized func(w http.ResponseWriter, r *http.Request) bool) (*httptest.Server, func() []string) {
+	t.Helper()
+	var mu sync.Mutex
+	var headers []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		headers = append(headers, r.Header.Get("Authorization"))
+		mu.Unlock()
+		if !authorized(w, r) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Header().Set("Content-Disposition", `attachment; filename="secret.bin"`)
+		http.ServeContent(w, r, "secret.bin", time.Time{}, bytes.NewReader(content))
+	}))
+	t.Cleanup(srv.Close)
+	return srv, func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string(nil), headers...)
+	}
+}
+
+func downloadWith(t *testing.T, credentials Credentials, rawURL string) string {
+	t.Helper()
+	dir := t.TempDir()
+	task, err := NewHttpDownloadTaskWithClient(t.Context(), ClientConfig{Credentials: credentials}, dir, rawURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	task.SetSegmentCount(4)
+	if err := task.Start(); err != nil {
+		t.Fatal(err)
+	}
+	waitStatus(t, task, StatusCompleted)
+	return dir
+}
+
+func TestBasicAndBearerAuth(t *testing.T) {
+	content := testContent(100000)
+	srv, headers := newAuthServer(t, content, func(w http.ResponseWriter, r *http.Request) bool {
+		user, password, ok := r.BasicAuth()
+		return ok && user == "alice" && password == "s3cret" || r.Header.Get("Authorization") == "Bearer t0ken"
+	})
+
+	dir := downloadWith(t, BasicAuth("alice", "s3cret"), srv.URL+"/secret.bin")
+	assertFile(t, filepath.Join(dir, "secret.bin"), content)
+	dir = downloadWith(t, BearerToken("t0ken"), srv.URL+"/secret.bin")
+	assertFile(t, filepath.Join(dir, "secret.bin"), content)
+	for _, h := range headers() {
+		if h == "" {
+			t.Errorf("a request was sent without credentials")
+		}
+	}
+
+	if _, err := NewHttpDownloadTaskWithClient(t.Context(), ClientConfig{Credentials: BasicAuth("alice", "wrong")}, t.TempDir(), srv.URL+"/secret.bin"); err == nil {
+		t.Errorf("expected wrong credentials to fail")
+	}
+}
+
+func TestDigestAuth(t *testing.T) {
+	content := testContent(100000)
+	const realm, nonce = "files", "dcd98b7102dd2f0e8b11d0f600bfb0c093"
+	h := func(s string) string {
+		sum := md5.Sum([]byte(s))
+		return hex.EncodeToString(sum[:])
+	}
+	srv, headers := newAuthServer(t, content, func(w http.ResponseWriter, r *http.Request) bool {
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Basic realm="files", Digest realm=%q, qop="auth,auth-int", nonce=%q, opaque="5ccc"`, realm, nonce))
+		scheme, rest, _ := strings.Cut(r.Header.Get("Authorization"), " ")
+		if scheme != "Digest" {
+			return false
+		}
+		p, _ := parseAuthParams(rest)
+		ha1 := h("alice:" + realm + ":s3cret")
+		ha2 := h(r.Method + ":" + r.URL.RequestURI())
+		expected := h(strings.Join([]string{ha1, nonce, p["nc"], p["cnonce"], p["qop"], ha2}, ":"))
+		return p["username"] == "alice" && p["uri"] == r.URL.RequestURI() && p["opaque"] == "5ccc" && p["response"] == expected
+	})
+
+	dir := downloadWith(t, DigestAuth("alice", "s3cret"), srv.URL+"/secret.bin")
+	assertFile(t, filepath.Join(dir, "secret.bin"), content)
+	// Only the first request waits for the challenge.
+	unauthenticated := 0
+	for _, h := range headers() {
+		if h == "" {
+			unauthenticated++
+		}
+	}
+	if unauthenticated != 1 {
+		t.Errorf("expected 1 request without credentials, got %d", unauthenticated)
+	}
+}
+
+func TestNetrc(t *testing.T) {
+	content := testContent(10000)
+	srv, _ := newAuthServer(t, content, func(w http.ResponseWriter, r *http.Request) bool {
+		user, password, ok := r.BasicAuth()
+		return ok && user == "bob" && password == "hunter2"
+	})
+
+	netrc, err := ParseNetrc(`
+# artifact servers
+machine files.example.com login carol password x
+macdef init
+	cd /pub
+
+machine 127.0.0.1
+	login bob
+	password hunter2
+default login anonymous password guest
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a, _ := netrc.lookup("FILES.example.com"); a.user != "carol" {
+		t.Errorf("expected the files.example.com login, got %q", a.user)
+	}
+	if a, _ := netrc.lookup("other.example.com"); a.user != "anonymous" {
+		t.Errorf("expected the default login, got %q", a.user)
+	}
+	dir := downloadWith(t, netrc, srv.URL+"/secret.bin")
+	assertFile(t, filepath.Join(dir, "secret.bin"), content)
+
+	if _, err := ParseNetrc("machine host login"); err == nil {
+		t.Errorf("expected a login without a value to fail")
+	}
+}
+
+func TestCredentialsRedirect(t *testing.T) {
+	content := testContent(10000)
+	mirror, mirrorHeaders := newAuthServer(t, content, func(w http.ResponseWriter, r *http.Request) bool { return true })
+	srv, headers := newAuthServer(t, nil, func(w http.ResponseWriter, r *http.Request) bool {
+		http.Redirect(w, r, mirror.URL+r.URL.Path, http.StatusFound)
+		return true
+	})
+
+	dir := downloadWith(t, BasicAuth("alice", "s3cret"), srv.URL+"/secret.bin")
+	assertFile(t, filepath.Join(dir, "secret.bin"), content)
+	if h := headers(); len(h) == 0 || h[0] == "" {
+		t.Errorf("the credentials were not sent to the original host")
+	}
+	for _, h := range mirrorHeaders() {
+		if h != "" {
+			t.Errorf("the credentials were sent to another host: %q", h)
+		}
+	}
+}
+
+func TestCredentialsNotSaved(t *testing.T) {
+	content := testContent(1000)
+	srv, _ := newAuthServer(t, content, func(w http.ResponseWriter, r *http.Request) bool {
+		_, password, _ := r.BasicAuth()
+		return password == "s3cret"
+	})
+	u, _ := url.Parse(srv.URL + "/secret.bin")
+	u.User = url.UserPassword("alice", "s3cret")
+
+	task, err := NewHttpDownloadTask(t.TempDir(), u.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if saved := task.state().Files[0].URL; saved != srv.URL+"/secret.bin" {
+		t.Errorf("expected the URL to be saved without credentials, got %q", saved)
+	}
+}
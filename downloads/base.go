@@ -1,6 +1,10 @@
 package downloads
 
 import (
+	"errors"
+	"fmt"
+	"slices"
+
 	"github.com/google/uuid"
 )
 
@@ -13,8 +17,46 @@ const (
 	StatusStarted   Status = "started"
 	StatusCompleted Status = "completed"
 	StatusFailed    Status = "failed"
+	StatusDeleted   Status = "deleted"
+	// StatusChecksumMismatch is a failure of a download whose data doesn't
+	// match its expected checksum. Starting it again downloads it from scratch.
+	StatusChecksumMismatch Status = "checksum_mismatch"
 )
 
+// statusTransitions lists the statuses a task may move to from each status.
+var statusTransitions = map[Status][]Status{
+	StatusQueued:           {StatusStarted, StatusPaused, StatusDeleted},
+	StatusStarted:          {StatusPaused, StatusQueued, StatusCompleted, StatusFailed, StatusChecksumMismatch, StatusDeleted},
+	StatusPaused:           {StatusStarted, StatusQueued, StatusDeleted},
+	StatusStopped:          {StatusStarted, StatusQueued, StatusDeleted},
+	StatusFailed:           {StatusStarted, StatusQueued, StatusDeleted},
+	StatusCompleted:        {StatusDeleted},
+	StatusChecksumMismatch: {StatusStarted, StatusQueued, StatusDeleted},
+}
+
+func (s Status) CanTransition(to Status) bool {
+	return slices.Contains(statusTransitions[s], to)
+}
+
+var ErrInvalidTransition = errors.New("invalid status transition")
+
+// TransitionError is returned when an operation isn't allowed in the current status of a task.
+type TransitionError struct {
+	From Status
+	To   Status
+}
+
+func (e *TransitionError) Error() string {
+	return fmt.Sprintf("can't change download task status from %s to %s", e.From, e.To)
+}
+
+func (e *TransitionError) Unwrap() error {
+	return ErrInvalidTransition
+}
+
+// DefaultWeight is the weight of new tasks in the split of the manager rate limit.
+const DefaultWeight = 1
+
 type DownloadTaskType string
 
 const (
@@ -22,6 +64,10 @@ const (
 	DownloadTaskTypeBT   DownloadTaskType = "BT"
 )
 
+// UnknownTotal is the total of files, and of the tasks containing them,
+// whose size isn't known until they are completed.
+const UnknownTotal = -1
+
 type DownloadFile interface {
 	GetId() uuid.UUID
 	GetName() string
@@ -46,4 +92,7 @@ type DownloadTask interface {
 	Stop() error
 	Delete() error
 	DeleteWithData() error
+
+	Subscribe() *Subscription
+	SubscribeFunc(fn func(Event)) *Subscription
 }
@@ -0,0 +1,300 @@
+package downloads
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+)
+
+type ChecksumAlgorithm string
+
+const (
+	ChecksumSHA256 ChecksumAlgorithm = "sha256"
+	ChecksumSHA512 ChecksumAlgorithm = "sha512"
+	ChecksumSHA1   ChecksumAlgorithm = "sha1"
+	ChecksumMD5    ChecksumAlgorithm = "md5"
+	ChecksumCRC32C ChecksumAlgorithm = "crc32c"
+)
+
+// checksumPreference lists the algorithms from the strongest, which is
+// picked when a server sends several digests.
+var checksumPreference = []ChecksumAlgorithm{ChecksumSHA512, ChecksumSHA256, ChecksumSHA1, ChecksumMD5, ChecksumCRC32C}
+
+// digestAlgorithms maps the names used by the Digest and Repr-Digest headers to algorithms.
+var digestAlgorithms = map[string]ChecksumAlgorithm{
+	"sha-256": ChecksumSHA256,
+	"sha-512": ChecksumSHA512,
+	"sha":     ChecksumSHA1,
+	"md5":     ChecksumMD5,
+	"crc32c":  ChecksumCRC32C,
+}
+
+func (a ChecksumAlgorithm) new() (hash.Hash, error) {
+	switch a {
+	case ChecksumSHA256:
+		return sha256.New(), nil
+	case ChecksumSHA512:
+		return sha512.New(), nil
+	case ChecksumSHA1:
+		return sha1.New(), nil
+	case ChecksumMD5:
+		return md5.New(), nil
+	case ChecksumCRC32C:
+		return crc32.New(crc32.MakeTable(crc32.Castagnoli)), nil
+	}
+	return nil, fmt.Errorf("unsupported checksum algorithm %q", a)
+}
+
+var ErrChecksumMismatch = errors.New("checksum mismatch")
+
+// ChecksumError is returned when the data of a completed file doesn't match
+// its expected checksum.
+type ChecksumError struct {
+	Algorithm ChecksumAlgorithm
+	Expected  []byte
+	Actual    []byte
+}
+
+func (e *ChecksumError) Error() string {
+	return fmt.Sprintf("%s checksum mismatch: expected %x, got %x", e.Algorithm, e.Expected, e.Actual)
+}
+
+func (e *ChecksumError) Unwrap() error {
+	return ErrChecksumMismatch
+}
+
+// Checksum is the expected digest of a file.
+type Checksum struct {
+	Algorithm ChecksumAlgorithm
+	Sum       []byte
+}
+
+// NewChecksum returns the checksum of algorithm with the hex encoded digest.
+func NewChecksum(algorithm ChecksumAlgorithm, digest string) (*Checksum, error) {
+	h, err := algorithm.new()
+	if err != nil {
+		return nil, err
+	}
+	sum, err := hex.DecodeString(digest)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s digest: %s", algorithm, err)
+	}
+	if len(sum) != h.Size() {
+		return nil, fmt.Errorf("invalid %s digest: expected %d bytes, got %d", algorithm, h.Size(), len(sum))
+	}
+	return &Checksum{Algorithm: algorithm, Sum: sum}, nil
+}
+
+// ParseChecksum parses a checksum formatted as "algorithm:hexdigest".
+func ParseChecksum(s string) (*Checksum, error) {
+	algorithm, digest, ok := strings.Cut(s, ":")
+	if !ok {
+		return nil, fmt.Errorf("invalid checksum %q", s)
+	}
+	return NewChecksum(ChecksumAlgorithm(strings.ToLower(algorithm)), digest)
+}
+
+func (c *Checksum) String() string {
+	return fmt.Sprintf("%s:%x", c.Algorithm, c.Sum)
+}
+
+func (c *Checksum) verify(sum []byte) error {
+	if !bytes.Equal(c.Sum, sum) {
+		return &ChecksumError{Algorithm: c.Algorithm, Expected: c.Sum, Actual: sum}
+	}
+	return nil
+}
+
+// decodeDigest decodes a digest sent by a server, which is base64 encoded
+// but sometimes hex encoded instead.
+func decodeDigest(algorithm ChecksumAlgorithm, value string) *Checksum {
+	h, err := algorithm.new()
+	if err != nil {
+		return nil
+	}
+	if sum, err := base64.StdEncoding.DecodeString(value); err == nil && len(sum) == h.Size() {
+		return &Checksum{Algorithm: algorithm, Sum: sum}
+	}
+	if sum, err := hex.DecodeString(value); err == nil && len(sum) == h.Size() {
+		return &Checksum{Algorithm: algorithm, Sum: sum}
+	}
+	return nil
+}
+
+// responseChecksum returns the strongest digest of the whole file sent with
+// resp in the Repr-Digest, Digest or Content-MD5 headers, or nil. Content-MD5
+// only covers the body, so it's ignored for partial responses.
+func responseChecksum(resp *http.Response) *Checksum {
+	found := make(map[ChecksumAlgorithm]*Checksum)
+	for _, name := range []string{"Repr-Digest", "Digest"} {
+		for _, header := range resp.Header.Values(name) {
+			for _, item := range strings.Split(header, ",") {
+				key, value, ok := strings.Cut(strings.TrimSpace(item), "=")
+				if !ok {
+					continue
+				}
+				algorithm, ok := digestAlgorithms[strings.ToLower(key)]
+				if !ok || found[algorithm] != nil {
+					continue
+				}
+				// Repr-Digest values are structured field byte sequences: ":base64:".
+				if c := decodeDigest(algorithm, strings.Trim(value, ":")); c != nil {
+					found[algorithm] = c
+				}
+			}
+		}
+	}
+	if value := resp.Header.Get("Content-MD5"); value != "" && resp.StatusCode != http.StatusPartialContent && found[ChecksumMD5] == nil {
+		found[ChecksumMD5] = decodeDigest(ChecksumMD5, value)
+	}
+	for _, algorithm := range checksumPreference {
+		if c := found[algorithm]; c != nil {
+			return c
+		}
+	}
+	return nil
+}
+
+// streamHasher hashes the data of a file in order while its segments are
+// downloaded in parallel. Data written past the hashed prefix is read back
+// from the file once the prefix reaches it, so a file downloaded over a
+// single connection is never read again.
+type streamHasher struct {
+	mu     sync.Mutex
+	hash   hash.Hash
+	offset int
+}
+
+func newStreamHasher(algorithm ChecksumAlgorithm) *streamHasher {
+	h, err := algorithm.new()
+	if err != nil {
+		return nil
+	}
+	return &streamHasher{hash: h}
+}
+
+// write hashes data written at offset and reports whether it extended the
+// hashed prefix.
+func (h *streamHasher) write(offset int, data []byte) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if offset > h.offset || offset+len(data) <= h.offset {
+		return false
+	}
+	h.hash.Write(data[h.offset-offset:])
+	h.offset = offset + len(data)
+	return true
+}
+
+// catchUp hashes the data of r up to end, which must already be written.
+func (h *streamHasher) catchUp(r io.ReaderAt, end int) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.offset >= end {
+		return nil
+	}
+	n, err := io.Copy(h.hash, io.NewSectionReader(r, int64(h.offset), int64(end-h.offset)))
+	h.offset += int(n)
+	if err == nil && h.offset < end {
+		err = io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+func (h *streamHasher) sum() []byte {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.hash.Sum(nil)
+}
+
+// SetChecksum sets the digest the file is verified against when it
+// completes. It replaces a digest sent by the server, nil disables the
+// verification.
+func (f *HttpDownloadFile) SetChecksum(c *Checksum) error {
+	if c != nil {
+		if _, err := c.Algorithm.new(); err != nil {
+			return err
+		}
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.checksum = c
+	f.resetHasher()
+	return nil
+}
+
+// GetChecksum returns the digest the file is verified against, or nil.
+func (f *HttpDownloadFile) GetChecksum() *Checksum {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.checksum
+}
+
+// resetHasher restarts the hashing of the file from its beginning. f.mu must be held.
+func (f *HttpDownloadFile) resetHasher() {
+	f.hasher = nil
+	if f.checksum != nil {
+		f.hasher = newStreamHasher(f.checksum.Algorithm)
+	}
+}
+
+// hash feeds data written at offset to the hasher. When it doesn't extend
+// the hashed prefix or completes segment s, the data downloaded by other
+// connections which follows the prefix is read back from the file.
+func (f *HttpDownloadFile) hash(s *fileSegment, offset int, data []byte) error {
+	f.mu.Lock()
+	h := f.hasher
+	f.mu.Unlock()
+	if h == nil {
+		return nil
+	}
+	if h.write(offset, data) {
+		f.mu.Lock()
+		done := s.remaining() <= 0
+		f.mu.Unlock()
+		if !done {
+			return nil
+		}
+	}
+	f.mu.Lock()
+	end, file := f.downloadedPrefix(), f.file
+	f.mu.Unlock()
+	return h.catchUp(file, end)
+}
+
+// verify checks the data of a completed file against its checksum. f.mu
+// must be held and no connection may be running.
+func (f *HttpDownloadFile) verify() error {
+	if f.checksum == nil {
+		return nil
+	}
+	if f.hasher == nil {
+		f.resetHasher()
+	}
+	var r io.ReaderAt = f.file
+	if f.file == nil {
+		file, err := f.openFile(f.partName(), os.O_RDONLY)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		r = file
+	}
+	if err := f.hasher.catchUp(r, f.Total); err != nil {
+		return err
+	}
+	return f.checksum.verify(f.hasher.sum())
+}
@@ -0,0 +1,142 @@
+package downloads
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestResponseChecksum(t *testing.T) {
+	content := testContent(1000)
+	sha256Sum := sha256.Sum256(content)
+	sha512Sum := sha512.Sum512(content)
+	md5Sum := md5.Sum(content)
+
+	resp := &http.Response{StatusCode: http.StatusOK, Header: http.Header{}}
+	resp.Header.Set("Content-MD5", base64.StdEncoding.EncodeToString(md5Sum[:]))
+	if c := responseChecksum(resp); c == nil || c.Algorithm != ChecksumMD5 || !bytes.Equal(c.Sum, md5Sum[:]) {
+		t.Errorf("expected md5 from Content-MD5, got %v", c)
+	}
+	resp.Header.Set("Digest", "unixsum=123, SHA-256="+base64.StdEncoding.EncodeToString(sha256Sum[:]))
+	if c := responseChecksum(resp); c == nil || c.Algorithm != ChecksumSHA256 || !bytes.Equal(c.Sum, sha256Sum[:]) {
+		t.Errorf("expected sha256 from Digest, got %v", c)
+	}
+	resp.Header.Set("Repr-Digest", "sha-512=:"+base64.StdEncoding.EncodeToString(sha512Sum[:])+":")
+	if c := responseChecksum(resp); c == nil || c.Algorithm != ChecksumSHA512 || !bytes.Equal(c.Sum, sha512Sum[:]) {
+		t.Errorf("expected sha512 from Repr-Digest, got %v", c)
+	}
+
+	partial := &http.Response{StatusCode: http.StatusPartialContent, Header: http.Header{}}
+	partial.Header.Set("Content-MD5", base64.StdEncoding.EncodeToString(md5Sum[:]))
+	if c := responseChecksum(partial); c != nil {
+		t.Errorf("Content-MD5 of a partial response must be ignored, got %v", c)
+	}
+}
+
+func TestParseChecksum(t *testing.T) {
+	sum := sha256.Sum256([]byte("data"))
+	c, err := ParseChecksum("SHA256:" + hex.EncodeToString(sum[:]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.String() != "sha256:"+hex.EncodeToString(sum[:]) {
+		t.Errorf("unexpected checksum %s", c)
+	}
+	for _, s := range []string{"sha256", "sha256:abcd", "sha3:" + hex.EncodeToString(sum[:])} {
+		if _, err := ParseChecksum(s); err == nil {
+			t.Errorf("%q: expected an error", s)
+		}
+	}
+}
+
+func TestSegmentedChecksum(t *testing.T) {
+	setMinSegmentSize(t, 1000)
+	content := testContent(10000)
+	srv := newTestServer(t, map[string][]byte{"seg.bin": content})
+	for _, algorithm := range []ChecksumAlgorithm{ChecksumSHA256, ChecksumSHA512, ChecksumSHA1, ChecksumMD5, ChecksumCRC32C} {
+		t.Run(string(algorithm), func(t *testing.T) {
+			dir := t.TempDir()
+			task, err := NewHttpDownloadTask(dir, srv.URL+"/seg.bin")
+			if err != nil {
+				t.Fatal(err)
+			}
+			h, _ := algorithm.new()
+			h.Write(content)
+			if err := task.Files[0].SetChecksum(&Checksum{Algorithm: algorithm, Sum: h.Sum(nil)}); err != nil {
+				t.Fatal(err)
+			}
+			task.SetSegmentCount(4)
+			if err := task.Start(); err != nil {
+				t.Fatal(err)
+			}
+			waitStatus(t, task, StatusCompleted)
+			assertFile(t, filepath.Join(dir, "seg.bin"), content)
+		})
+	}
+}
+
+func TestChecksumMismatch(t *testing.T) {
+	content := testContent(10000)
+	srv := newTestServer(t, map[string][]byte{"a.bin": content})
+	dir := t.TempDir()
+
+	task, err := NewHttpDownloadTask(dir, srv.URL+"/a.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256([]byte("something else"))
+	task.Files[0].SetChecksum(&Checksum{Algorithm: ChecksumSHA256, Sum: sum[:]})
+	if err := task.Start(); err != nil {
+		t.Fatal(err)
+	}
+	waitStatus(t, task, StatusChecksumMismatch)
+	var checksumErr *ChecksumError
+	if !errors.As(task.GetError(), &checksumErr) || !errors.Is(task.GetError(), ErrChecksumMismatch) {
+		t.Fatalf("expected a checksum error, got %v", task.GetError())
+	}
+	if actual := sha256.Sum256(content); !bytes.Equal(checksumErr.Actual, actual[:]) {
+		t.Errorf("unexpected actual checksum %x", checksumErr.Actual)
+	}
+
+	// With the right checksum, starting again downloads the file from scratch.
+	sum = sha256.Sum256(content)
+	task.Files[0].SetChecksum(&Checksum{Algorithm: ChecksumSHA256, Sum: sum[:]})
+	if err := task.Start(); err != nil {
+		t.Fatal(err)
+	}
+	waitStatus(t, task, StatusCompleted)
+}
+
+func TestServerDigestVerified(t *testing.T) {
+	content := testContent(10000)
+	corrupted := bytes.Clone(content)
+	corrupted[5000] ^= 0xff
+	sum := sha256.Sum256(content)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Disposition", `attachment; filename="digest.bin"`)
+		w.Header().Set("Repr-Digest", "sha-256=:"+base64.StdEncoding.EncodeToString(sum[:])+":")
+		http.ServeContent(w, r, "digest.bin", time.Time{}, bytes.NewReader(corrupted))
+	}))
+	t.Cleanup(srv.Close)
+
+	task, err := NewHttpDownloadTask(t.TempDir(), srv.URL+"/digest.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c := task.Files[0].GetChecksum(); c == nil || c.Algorithm != ChecksumSHA256 {
+		t.Fatalf("expected the checksum sent by the server, got %v", c)
+	}
+	if err := task.Start(); err != nil {
+		t.Fatal(err)
+	}
+	waitStatus(t, task, StatusChecksumMismatch)
+}
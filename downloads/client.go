@@ -0,0 +1,202 @@
+package downloads
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// ClientConfig describes the HTTP client every request of a download is
+// made with. The zero value behaves like http.DefaultClient.
+type ClientConfig struct {
+	// Transport replaces the transport built from the settings below when set.
+	Transport http.RoundTripper
+	// Proxy picks the proxy of a request, http.ProxyFromEnvironment when nil.
+	Proxy func(*http.Request) (*url.URL, error)
+	// TLSConfig sets the CA bundle, client certificates, minimum version
+	// and other TLS settings.
+	TLSConfig *tls.Config
+	// DialTimeout, TLSHandshakeTimeout and ResponseHeaderTimeout bound the
+	// steps of every request. There is no timeout for the whole request, as
+	// downloads may legitimately take hours.
+	DialTimeout           time.Duration
+	TLSHandshakeTimeout   time.Duration
+	ResponseHeaderTimeout time.Duration
+	// IdleConnTimeout, MaxIdleConnsPerHost and MaxConnsPerHost limit the
+	// kept-alive connections. DisableKeepAlives closes every connection
+	// after its request.
+	IdleConnTimeout     time.Duration
+	MaxIdleConnsPerHost int
+	MaxConnsPerHost     int
+	DisableKeepAlives   bool
+	// Header is added to every request, UserAgent replaces the default
+	// User-Agent when not empty.
+	Header    http.Header
+	UserAgent string
+	// CheckRedirect decides whether to follow redirects as in http.Client.
+	// When nil, at most MaxRedirects redirects are followed, 10 when zero.
+	// The Authorization header is never sent to another host.
+	CheckRedirect func(req *http.Request, via []*http.Request) error
+	MaxRedirects  int
+	// Credentials authenticate every request when set.
+	Credentials Credentials
+	// Jar keeps the cookies of the session, see CookieJar.
+	Jar http.CookieJar
+}
+
+// httpClient is the client built from a ClientConfig.
+type httpClient struct {
+	client      *http.Client
+	header      http.Header
+	userAgent   string
+	credentials Credentials
+}
+
+var defaultHttpClient = &httpClient{client: http.DefaultClient}
+
+func newHttpClient(c ClientConfig) *httpClient {
+	transport := c.Transport
+	if transport == nil {
+		transport = c.transport()
+	}
+	checkRedirect := c.CheckRedirect
+	if checkRedirect == nil {
+		maxRedirects := c.MaxRedirects
+		if maxRedirects <= 0 {
+			maxRedirects = 10
+		}
+		checkRedirect = func(req *http.Request, via []*http.Request) error {
+			if len(via) > maxRedirects {
+				return fmt.Errorf("stopped after %d redirects", maxRedirects)
+			}
+			return nil
+		}
+	}
+	return &httpClient{
+		client: &http.Client{
+			Transport: transport,
+			Jar:       c.Jar,
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				// http.Client keeps the header for subdomains and other ports.
+				if req.URL.Host != via[0].URL.Host {
+					req.Header.Del("Authorization")
+				}
+				return checkRedirect(req, via)
+			},
+		},
+		header:      c.Header.Clone(),
+		userAgent:   c.UserAgent,
+		credentials: c.Credentials,
+	}
+}
+
+func (c ClientConfig) transport() *http.Transport {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	if c.Proxy != nil {
+		t.Proxy = c.Proxy
+	}
+	if c.TLSConfig != nil {
+		t.TLSClientConfig = c.TLSConfig.Clone()
+	}
+	if c.DialTimeout > 0 {
+		dialer := &net.Dialer{Timeout: c.DialTimeout, KeepAlive: 30 * time.Second}
+		t.DialContext = dialer.DialContext
+	}
+	if c.TLSHandshakeTimeout > 0 {
+		t.TLSHandshakeTimeout = c.TLSHandshakeTimeout
+	}
+	t.ResponseHeaderTimeout = c.ResponseHeaderTimeout
+	if c.IdleConnTimeout > 0 {
+		t.IdleConnTimeout = c.IdleConnTimeout
+	}
+	t.MaxIdleConnsPerHost = c.MaxIdleConnsPerHost
+	t.MaxConnsPerHost = c.MaxConnsPerHost
+	t.DisableKeepAlives = c.DisableKeepAlives
+	return t
+}
+
+// newRequest builds a request with the default headers of the client.
+func (c *httpClient) newRequest(ctx context.Context, method, url string) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, method, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range c.header {
+		req.Header[name] = append([]string(nil), values...)
+	}
+	if c.userAgent != "" {
+		req.Header.Set("User-Agent", c.userAgent)
+	}
+	return req, nil
+}
+
+// do sends req with the credentials of the client, answering at most one
+// authentication challenge of the host of req.
+func (c *httpClient) do(req *http.Request) (*http.Response, error) {
+	if c.credentials == nil {
+		return c.client.Do(req)
+	}
+	if _, err := c.credentials.Authorize(req, nil); err != nil {
+		return nil, err
+	}
+	resp, err := c.client.Do(req)
+	if err != nil || resp.StatusCode != http.StatusUnauthorized || resp.Request.URL.Host != req.URL.Host {
+		return resp, err
+	}
+	retry, err := c.credentials.Authorize(req, resp)
+	if err != nil || !retry {
+		if err != nil {
+			resp.Body.Close()
+			return nil, err
+		}
+		return resp, nil
+	}
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+	resp.Body.Close()
+	return c.client.Do(req)
+}
+
+// SetClientConfig sets the HTTP client of the tasks added to the manager
+// which don't have their own.
+func (m *Manager) SetClientConfig(c ClientConfig) {
+	client := newHttpClient(c)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.client = client
+}
+
+func (m *Manager) httpClient() *httpClient {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.client != nil {
+		return m.client
+	}
+	return defaultHttpClient
+}
+
+// SetClientConfig sets the HTTP client of the task, overriding the one of
+// its manager. It applies to the requests made after the call.
+func (dt *HttpDownloadTask) SetClientConfig(c ClientConfig) {
+	client := newHttpClient(c)
+	dt.mu.Lock()
+	defer dt.mu.Unlock()
+	dt.client = client
+}
+
+func (dt *HttpDownloadTask) httpClient() *httpClient {
+	dt.mu.Lock()
+	client, m := dt.client, dt.manager
+	dt.mu.Unlock()
+	if client != nil {
+		return client
+	}
+	if m != nil {
+		return m.httpClient()
+	}
+	return defaultHttpClient
+}
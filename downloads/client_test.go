@@ -0,0 +1,125 @@
+package downloads
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestClientConfigHeaders(t *testing.T) {
+	content := testContent(10000)
+	srv := newTestServer(t, map[string][]byte{"a.bin": content})
+	dir := t.TempDir()
+	m := NewManager(dir, 1)
+	m.SetClientConfig(ClientConfig{
+		Header:    http.Header{"X-Token": {"secret"}},
+		UserAgent: "dls-test",
+	})
+
+	task, err := m.Add(srv.URL + "/a.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitStatus(t, task, StatusCompleted)
+	assertFile(t, filepath.Join(dir, "a.bin"), content)
+
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	for _, r := range srv.requests {
+		if r.Header.Get("X-Token") != "secret" || r.UserAgent() != "dls-test" {
+			t.Errorf("%s request without the configured headers: %v", r.Method, r.Header)
+		}
+	}
+}
+
+func TestClientConfigProxy(t *testing.T) {
+	content := testContent(10000)
+	var mu sync.Mutex
+	var proxied []string
+	// The proxy answers every request itself instead of forwarding it.
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		proxied = append(proxied, r.URL.String())
+		mu.Unlock()
+		w.Header().Set("Content-Disposition", `attachment; filename="proxied.bin"`)
+		http.ServeContent(w, r, "proxied.bin", time.Time{}, bytes.NewReader(content))
+	}))
+	t.Cleanup(proxy.Close)
+	proxyURL, _ := url.Parse(proxy.URL)
+	dir := t.TempDir()
+
+	task, err := NewHttpDownloadTaskWithClient(t.Context(), ClientConfig{Proxy: http.ProxyURL(proxyURL)}, dir, "http://downloads.invalid/file.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := task.Start(); err != nil {
+		t.Fatal(err)
+	}
+	waitStatus(t, task, StatusCompleted)
+	assertFile(t, filepath.Join(dir, "proxied.bin"), content)
+	mu.Lock()
+	defer mu.Unlock()
+	if len(proxied) < 2 || proxied[0] != "http://downloads.invalid/file.bin" {
+		t.Errorf("requests didn't go through the proxy: %q", proxied)
+	}
+}
+
+func TestClientConfigTLS(t *testing.T) {
+	content := testContent(10000)
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Disposition", `attachment; filename="tls.bin"`)
+		http.ServeContent(w, r, "tls.bin", time.Time{}, bytes.NewReader(content))
+	}))
+	// The rejected handshake is expected.
+	srv.Config.ErrorLog = log.New(io.Discard, "", 0)
+	srv.StartTLS()
+	t.Cleanup(srv.Close)
+	dir := t.TempDir()
+
+	if _, err := NewHttpDownloadTask(dir, srv.URL+"/tls.bin"); err == nil {
+		t.Fatal("expected the default client to reject the test CA")
+	}
+
+	pool := x509.NewCertPool()
+	pool.AddCert(srv.Certificate())
+	config := ClientConfig{TLSConfig: &tls.Config{RootCAs: pool, MinVersion: tls.VersionTLS12}}
+	task, err := NewHttpDownloadTaskWithClient(t.Context(), config, dir, srv.URL+"/tls.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := task.Start(); err != nil {
+		t.Fatal(err)
+	}
+	waitStatus(t, task, StatusCompleted)
+	assertFile(t, filepath.Join(dir, "tls.bin"), content)
+}
+
+func TestClientConfigRedirects(t *testing.T) {
+	content := testContent(1000)
+	files := newTestServer(t, map[string][]byte{"a.bin": content})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/twice" {
+			http.Redirect(w, r, "/once", http.StatusFound)
+			return
+		}
+		http.Redirect(w, r, files.URL+"/a.bin", http.StatusFound)
+	}))
+	t.Cleanup(srv.Close)
+	config := ClientConfig{MaxRedirects: 1}
+
+	if _, err := NewHttpDownloadTaskWithClient(t.Context(), config, t.TempDir(), srv.URL+"/once"); err != nil {
+		t.Errorf("one redirect must be followed: %v", err)
+	}
+	if _, err := NewHttpDownloadTaskWithClient(t.Context(), config, t.TempDir(), srv.URL+"/twice"); err == nil {
+		t.Errorf("expected two redirects to be refused")
+	}
+}
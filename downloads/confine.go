@@ -0,0 +1,178 @@
+package downloads
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ErrUnsafePath is returned when a file would be written or removed
+// outside of the directory of its task.
+var ErrUnsafePath = errors.New("unsafe file path")
+
+// UnsafePathError describes a file refused because its path leaves Root,
+// the download directory of its task.
+type UnsafePathError struct {
+	Root   string
+	Path   string
+	Reason string
+}
+
+func (e *UnsafePathError) Error() string {
+	return fmt.Sprintf("refusing to access %s outside of %s: %s", e.Path, e.Root, e.Reason)
+}
+
+func (e *UnsafePathError) Unwrap() error {
+	return ErrUnsafePath
+}
+
+// unsafeNameReason returns why name can't be the name of a file in a
+// directory, empty when it can.
+func unsafeNameReason(name string) string {
+	switch {
+	case name == "" || name == "." || name == "..":
+		return "invalid file name"
+	case filepath.IsAbs(name) || strings.HasPrefix(name, "/") || strings.HasPrefix(name, `\`):
+		return "absolute file name"
+	case len(name) >= 2 && name[1] == ':' && ('a' <= name[0]|0x20 && name[0]|0x20 <= 'z'):
+		return "drive-relative file name"
+	case strings.ContainsAny(name, `/\`):
+		return "file name with directories"
+	case strings.ContainsRune(name, 0):
+		return "file name with a NUL byte"
+	}
+	return ""
+}
+
+// maxLinks is the number of symbolic links followed before giving up.
+const maxLinks = 40
+
+// within reports whether path is root or inside it. Both must be clean and
+// absolute.
+func within(root, path string) bool {
+	rel, err := filepath.Rel(root, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// confine returns the path of the file name in dir relative to root, or an
+// UnsafePathError when it isn't inside root, symbolic links included.
+func confine(root, dir, name string) (string, error) {
+	path := filepath.Join(dir, name)
+	unsafe := func(reason string) error {
+		return &UnsafePathError{Root: root, Path: path, Reason: reason}
+	}
+	if reason := unsafeNameReason(name); reason != "" {
+		return "", unsafe(reason)
+	}
+	absRoot, err := filepath.Abs(root)
+	if err != nil {
+		return "", err
+	}
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+	if !within(absRoot, absPath) || absRoot == absPath {
+		return "", unsafe("path leaves the download directory")
+	}
+	// The root itself may be a link, what it contains may not lead out of it.
+	realRoot, err := filepath.EvalSymlinks(absRoot)
+	if err != nil {
+		return "", err
+	}
+	realDir, err := filepath.EvalSymlinks(filepath.Dir(absPath))
+	if err != nil {
+		return "", err
+	}
+	if !within(realRoot, realDir) {
+		return "", unsafe("symbolic link leaves the download directory")
+	}
+	// Follow the links of the file itself, including dangling ones, which
+	// creating it would follow.
+	link := filepath.Join(realDir, filepath.Base(absPath))
+	for i := 0; ; i++ {
+		if info, err := os.Lstat(link); err != nil || info.Mode()&os.ModeSymlink == 0 {
+			break
+		}
+		if i == maxLinks {
+			return "", unsafe("too many symbolic links")
+		}
+		target, err := os.Readlink(link)
+		if err != nil {
+			return "", err
+		}
+		if !filepath.IsAbs(target) {
+			target = filepath.Join(filepath.Dir(link), target)
+		}
+		dir, err := filepath.EvalSymlinks(filepath.Dir(target))
+		if err != nil {
+			return "", err
+		}
+		if !within(realRoot, dir) {
+			return "", unsafe("symbolic link leaves the download directory")
+		}
+		link = filepath.Join(dir, filepath.Base(target))
+	}
+	return filepath.Rel(absRoot, absPath)
+}
+
+// openFile opens the file name of the directory of f, refusing paths
+// outside of the directory of its task.
+func (f *HttpDownloadFile) openFile(name string, flag int) (*os.File, error) {
+	rel, err := confine(f.task.Path, f.Path, name)
+	if err != nil {
+		return nil, err
+	}
+	// Opening through a root also refuses links swapped in since confine.
+	root, err := os.OpenRoot(f.task.Path)
+	if err != nil {
+		return nil, err
+	}
+	defer root.Close()
+	return root.OpenFile(rel, flag, 0666)
+}
+
+// removeFile removes the file name of the directory of f, refusing paths
+// outside of the directory of its task.
+func (f *HttpDownloadFile) removeFile(name string) error {
+	rel, err := confine(f.task.Path, f.Path, name)
+	if err != nil {
+		return err
+	}
+	root, err := os.OpenRoot(f.task.Path)
+	if err != nil {
+		return err
+	}
+	defer root.Close()
+	return root.Remove(rel)
+}
+
+// renameFile renames the file from of the directory of f to, refusing paths
+// outside of the directory of its task.
+func (f *HttpDownloadFile) renameFile(from, to string) error {
+	fromRel, err := confine(f.task.Path, f.Path, from)
+	if err != nil {
+		return err
+	}
+	toRel, err := confine(f.task.Path, f.Path, to)
+	if err != nil {
+		return err
+	}
+	// Renaming doesn't follow links in the names themselves, only their
+	// directory has to stay inside. Opening it through a root refuses links
+	// swapped in since confine; one swapped in between this check and the
+	// rename is not caught.
+	root, err := os.OpenRoot(f.task.Path)
+	if err != nil {
+		return err
+	}
+	defer root.Close()
+	dir, err := root.OpenRoot(filepath.Dir(fromRel))
+	if err != nil {
+		return err
+	}
+	dir.Close()
+	return os.Rename(filepath.Join(f.task.Path, fromRel), filepath.Join(f.task.Path, toRel))
+}
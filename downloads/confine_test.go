@@ -0,0 +1,98 @@
+package downloads
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func TestConfine(t *testing.T) {
+	root := t.TempDir()
+	outside := t.TempDir()
+	for _, dir := range []string{"sub", "inside"} {
+		if err := os.Mkdir(filepath.Join(root, dir), 0777); err != nil {
+			t.Fatal(err)
+		}
+	}
+	links := map[string]string{
+		"out":           outside,
+		"in":            filepath.Join(root, "inside"),
+		"out.bin":       filepath.Join(outside, "target.bin"),
+		"in.bin":        filepath.Join(root, "inside", "target.bin"),
+		"sub/up.bin":    filepath.Join("..", "..", filepath.Base(outside), "target.bin"),
+		"sub/local.bin": "../inside/target.bin",
+	}
+	for link, target := range links {
+		if err := os.Symlink(target, filepath.Join(root, link)); err != nil {
+			t.Skipf("symbolic links are not supported: %v", err)
+		}
+	}
+
+	for _, c := range []struct {
+		dir, name string
+		safe      bool
+	}{
+		{root, "file.bin", true},
+		{filepath.Join(root, "sub"), "file.bin", true},
+		{filepath.Join(root, "in"), "file.bin", true},
+		{root, "in.bin", true},
+		{filepath.Join(root, "sub"), "local.bin", true},
+		{root, "../file.bin", false},
+		{root, "..", false},
+		{root, "/etc/passwd", false},
+		{root, `C:evil.bin`, false},
+		{root, `sub\file.bin`, false},
+		{filepath.Join(root, ".."), filepath.Base(root), false},
+		{filepath.Join(root, "sub", "..", ".."), "file.bin", false},
+		{filepath.Join(root, "out"), "file.bin", false},
+		{root, "out.bin", false},
+		{filepath.Join(root, "sub"), "up.bin", false},
+	} {
+		_, err := confine(root, c.dir, c.name)
+		var unsafe *UnsafePathError
+		if c.safe && err != nil {
+			t.Errorf("%s %s: unexpected error %v", c.dir, c.name, err)
+		} else if !c.safe && (!errors.As(err, &unsafe) || !errors.Is(err, ErrUnsafePath)) {
+			t.Errorf("%s %s: expected an UnsafePathError, got %v", c.dir, c.name, err)
+		}
+	}
+}
+
+func TestRestoredNameCantEscape(t *testing.T) {
+	content := testContent(5000)
+	srv := newTestServer(t, map[string][]byte{"data.bin": content})
+	parent := t.TempDir()
+	dir := filepath.Join(parent, "downloads")
+	if err := os.Mkdir(dir, 0777); err != nil {
+		t.Fatal(err)
+	}
+	saved := TaskState{
+		Id:     uuid.New(),
+		Type:   DownloadTaskTypeHTTP,
+		Name:   "data.bin",
+		Path:   dir,
+		Status: StatusStarted,
+		Files: []FileState{{
+			Id:     uuid.New(),
+			Name:   "../data.bin",
+			Path:   dir,
+			URL:    srv.URL + "/data.bin",
+			Total:  len(content),
+			Status: StatusStarted,
+		}},
+	}
+	task := loadSaved(t, dir, saved)
+	waitStatus(t, task, StatusFailed)
+	if !errors.Is(task.GetError(), ErrUnsafePath) {
+		t.Errorf("expected ErrUnsafePath, got %v", task.GetError())
+	}
+	if _, err := os.Stat(filepath.Join(parent, "data.bin")); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("a file was written outside of the download directory: %v", err)
+	}
+	if err := task.DeleteWithData(); !errors.Is(err, ErrUnsafePath) {
+		t.Errorf("expected DeleteWithData to refuse the path, got %v", err)
+	}
+}
@@ -0,0 +1,297 @@
+package downloads
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/publicsuffix"
+)
+
+// CookieJar is an http.CookieJar which can import and export the Netscape
+// cookies.txt format used by browser extensions, curl and wget. Set it as
+// ClientConfig.Jar so that the cookies of a session are sent with every
+// request of a download, including resumes.
+//
+// A server may set cookies for its parent domains, except for public
+// suffixes such as "com" or "co.uk" which would send them to every site
+// under them. Imported cookies are trusted as they are.
+type CookieJar struct {
+	mu      sync.Mutex
+	cookies map[string]*jarCookie
+	// now returns the current time, time.Now when nil.
+	now func() time.Time
+}
+
+type jarCookie struct {
+	Name, Value string
+	Domain      string
+	// HostOnly cookies are only sent to Domain itself, not to its
+	// subdomains.
+	HostOnly bool
+	Path     string
+	Secure   bool
+	HttpOnly bool
+	// Expires is zero for session cookies.
+	Expires time.Time
+}
+
+func (c *jarCookie) key() string {
+	return c.Domain + ";" + c.Path + ";" + c.Name
+}
+
+func (c *jarCookie) expired(now time.Time) bool {
+	return !c.Expires.IsZero() && !c.Expires.After(now)
+}
+
+func NewCookieJar() *CookieJar {
+	return &CookieJar{cookies: map[string]*jarCookie{}}
+}
+
+// LoadCookieJar reads a cookies.txt file.
+func LoadCookieJar(path string) (*CookieJar, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	j := NewCookieJar()
+	if err := j.Import(f); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return j, nil
+}
+
+func (j *CookieJar) timeNow() time.Time {
+	if j.now != nil {
+		return j.now()
+	}
+	return time.Now()
+}
+
+// SetCookies stores the cookies received in a response to u.
+func (j *CookieJar) SetCookies(u *url.URL, cookies []*http.Cookie) {
+	host := canonicalHost(u)
+	now := j.timeNow()
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	for _, c := range cookies {
+		jc := &jarCookie{Name: c.Name, Value: c.Value, Path: c.Path, Secure: c.Secure, HttpOnly: c.HttpOnly}
+		if domain := strings.TrimPrefix(strings.ToLower(c.Domain), "."); domain == "" || domain == host {
+			jc.Domain, jc.HostOnly = host, true
+		} else if net.ParseIP(host) == nil && domainMatch(host, domain) && !isPublicSuffix(domain) {
+			jc.Domain = domain
+		} else {
+			continue
+		}
+		if !strings.HasPrefix(jc.Path, "/") {
+			jc.Path = defaultCookiePath(u.Path)
+		}
+		switch {
+		case c.MaxAge < 0:
+			jc.Expires = now
+		case c.MaxAge > 0:
+			jc.Expires = now.Add(time.Duration(c.MaxAge) * time.Second)
+		default:
+			jc.Expires = c.Expires
+		}
+		if jc.expired(now) {
+			delete(j.cookies, jc.key())
+			continue
+		}
+		j.cookies[jc.key()] = jc
+	}
+}
+
+// Cookies returns the cookies to send in a request to u, longest paths
+// first.
+func (j *CookieJar) Cookies(u *url.URL) []*http.Cookie {
+	host := canonicalHost(u)
+	secure := u.Scheme == "https" || u.Scheme == "wss"
+	path := u.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	now := j.timeNow()
+	j.mu.Lock()
+	var matches []*jarCookie
+	for key, c := range j.cookies {
+		if c.expired(now) {
+			delete(j.cookies, key)
+			continue
+		}
+		if c.HostOnly && c.Domain != host || !c.HostOnly && !domainMatch(host, c.Domain) {
+			continue
+		}
+		if c.Secure && !secure || !pathMatch(path, c.Path) {
+			continue
+		}
+		matches = append(matches, c)
+	}
+	j.mu.Unlock()
+	sort.Slice(matches, func(a, b int) bool {
+		if len(matches[a].Path) != len(matches[b].Path) {
+			return len(matches[a].Path) > len(matches[b].Path)
+		}
+		return matches[a].Name < matches[b].Name
+	})
+	cookies := make([]*http.Cookie, len(matches))
+	for i, c := range matches {
+		cookies[i] = &http.Cookie{Name: c.Name, Value: c.Value}
+	}
+	return cookies
+}
+
+// httpOnlyPrefix marks HttpOnly cookies in cookies.txt files.
+const httpOnlyPrefix = "#HttpOnly_"
+
+// Import adds the cookies of a cookies.txt file to the jar. Expired
+// cookies are skipped.
+func (j *CookieJar) Import(r io.Reader) error {
+	now := j.timeNow()
+	lines := bufio.NewScanner(r)
+	lines.Buffer(nil, 1<<20)
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	for n := 1; lines.Scan(); n++ {
+		line := strings.TrimRight(lines.Text(), "\r")
+		httpOnly := strings.HasPrefix(line, httpOnlyPrefix)
+		line = strings.TrimPrefix(line, httpOnlyPrefix)
+		if strings.TrimSpace(line) == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Split(line, "\t")
+		if len(fields) == 6 {
+			// Cookies without a value.
+			fields = append(fields, "")
+		}
+		if len(fields) != 7 {
+			return fmt.Errorf("line %d: expected 7 fields, got %d", n, len(fields))
+		}
+		expires, err := strconv.ParseInt(fields[4], 10, 64)
+		if err != nil {
+			return fmt.Errorf("line %d: invalid expiry %q", n, fields[4])
+		}
+		c := &jarCookie{
+			Name:     fields[5],
+			Value:    fields[6],
+			Domain:   strings.TrimPrefix(strings.ToLower(fields[0]), "."),
+			HostOnly: !strings.EqualFold(fields[1], "TRUE"),
+			Path:     fields[2],
+			Secure:   strings.EqualFold(fields[3], "TRUE"),
+			HttpOnly: httpOnly,
+		}
+		if expires > 0 {
+			c.Expires = time.Unix(expires, 0)
+		}
+		if c.expired(now) {
+			continue
+		}
+		j.cookies[c.key()] = c
+	}
+	return lines.Err()
+}
+
+// Export writes the cookies of the jar in the cookies.txt format, session
+// cookies included.
+func (j *CookieJar) Export(w io.Writer) error {
+	now := j.timeNow()
+	j.mu.Lock()
+	cookies := make([]*jarCookie, 0, len(j.cookies))
+	for _, c := range j.cookies {
+		if !c.expired(now) {
+			cookies = append(cookies, c)
+		}
+	}
+	j.mu.Unlock()
+	sort.Slice(cookies, func(a, b int) bool { return cookies[a].key() < cookies[b].key() })
+
+	bw := bufio.NewWriter(w)
+	fmt.Fprintln(bw, "# Netscape HTTP Cookie File")
+	for _, c := range cookies {
+		domain, subdomains := c.Domain, "FALSE"
+		if !c.HostOnly {
+			domain, subdomains = "."+domain, "TRUE"
+		}
+		if c.HttpOnly {
+			domain = httpOnlyPrefix + domain
+		}
+		var expires int64
+		if !c.Expires.IsZero() {
+			expires = c.Expires.Unix()
+		}
+		fmt.Fprintf(bw, "%s\t%s\t%s\t%s\t%d\t%s\t%s\n", domain, subdomains, c.Path, strings.ToUpper(strconv.FormatBool(c.Secure)), expires, c.Name, c.Value)
+	}
+	return bw.Flush()
+}
+
+// Save writes the cookies of the jar to a cookies.txt file, which is
+// replaced atomically. The file is only readable by its owner.
+func (j *CookieJar) Save(path string) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if err := j.Export(tmp); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func canonicalHost(u *url.URL) string {
+	return strings.TrimSuffix(strings.ToLower(u.Hostname()), ".")
+}
+
+// isPublicSuffix reports whether cookies for domain would be shared by
+// unrelated sites, as for top level domains and the suffixes of the public
+// suffix list.
+func isPublicSuffix(domain string) bool {
+	if !strings.Contains(domain, ".") {
+		return true
+	}
+	suffix, _ := publicsuffix.PublicSuffix(domain)
+	return suffix == domain
+}
+
+// domainMatch reports whether host is domain or one of its subdomains.
+func domainMatch(host, domain string) bool {
+	return host == domain || strings.HasSuffix(host, "."+domain)
+}
+
+// pathMatch reports whether the cookies of cookiePath are sent to path,
+// RFC 6265 section 5.1.4.
+func pathMatch(path, cookiePath string) bool {
+	if !strings.HasPrefix(path, cookiePath) {
+		return false
+	}
+	return len(path) == len(cookiePath) || strings.HasSuffix(cookiePath, "/") || path[len(cookiePath)] == '/'
+}
+
+// defaultCookiePath is the directory of the request path, RFC 6265 section
+// 5.1.4.
+func defaultCookiePath(path string) string {
+	i := strings.LastIndex(path, "/")
+	if i <= 0 {
+		return "/"
+	}
+	return path[:i]
+}
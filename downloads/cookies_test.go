@@ -0,0 +1,149 @@
+package downloads
+
+import (
+	"bytes"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCookieJarSession(t *testing.T) {
+	content := testContent(100000)
+	srv, _ := newAuthServer(t, content, func(w http.ResponseWriter, r *http.Request) bool {
+		if r.Method == http.MethodHead {
+			http.SetCookie(w, &http.Cookie{Name: "session", Value: "abc", Path: "/", HttpOnly: true})
+			return true
+		}
+		c, err := r.Cookie("session")
+		return err == nil && c.Value == "abc"
+	})
+	jar := NewCookieJar()
+	dir := t.TempDir()
+
+	task, err := NewHttpDownloadTaskWithClient(t.Context(), ClientConfig{Jar: jar}, dir, srv.URL+"/secret.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	task.SetSegmentCount(4)
+	if err := task.Start(); err != nil {
+		t.Fatal(err)
+	}
+	waitStatus(t, task, StatusCompleted)
+	assertFile(t, filepath.Join(dir, "secret.bin"), content)
+
+	var exported bytes.Buffer
+	if err := jar.Export(&exported); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(exported.String(), "#HttpOnly_127.0.0.1\tFALSE\t/\tFALSE\t0\tsession\tabc\n") {
+		t.Errorf("the session cookie was not exported:\n%s", exported.String())
+	}
+}
+
+const testCookies = `# Netscape HTTP Cookie File
+# https://curl.se/docs/http-cookies.html
+
+.example.com	TRUE	/	FALSE	0	site	1
+files.example.com	FALSE	/pub	TRUE	4102444800	secure	2
+#HttpOnly_files.example.com	FALSE	/	FALSE	4102444800	http_only	3
+.example.com	TRUE	/	FALSE	946684800	expired	4
+files.example.com	FALSE	/	FALSE	0	empty
+`
+
+func TestCookieJarImport(t *testing.T) {
+	jar := NewCookieJar()
+	if err := jar.Import(strings.NewReader(testCookies)); err != nil {
+		t.Fatal(err)
+	}
+	cases := map[string]string{
+		"https://files.example.com/pub/a.iso":   "secure=2 empty= http_only=3 site=1",
+		"http://files.example.com/pub/a.iso":    "empty= http_only=3 site=1",
+		"https://files.example.com/public/a":    "empty= http_only=3 site=1",
+		"https://mirror.files.example.com/a":    "site=1",
+		"https://example.com/":                  "site=1",
+		"https://example.org/pub/a.iso":         "",
+		"https://files.example.com.evil.org/a/": "",
+	}
+	for rawURL, expected := range cases {
+		u, _ := url.Parse(rawURL)
+		var got []string
+		for _, c := range jar.Cookies(u) {
+			got = append(got, c.String())
+		}
+		if strings.Join(got, " ") != expected {
+			t.Errorf("%s: expected %q, got %q", rawURL, expected, got)
+		}
+	}
+
+	var exported bytes.Buffer
+	if err := jar.Export(&exported); err != nil {
+		t.Fatal(err)
+	}
+	imported := NewCookieJar()
+	if err := imported.Import(&exported); err != nil {
+		t.Fatal(err)
+	}
+	u, _ := url.Parse("https://files.example.com/pub/a.iso")
+	if len(imported.Cookies(u)) != 4 {
+		t.Errorf("the exported cookies don't round-trip:\n%s", exported.String())
+	}
+
+	if err := jar.Import(strings.NewReader("example.com\tTRUE\t/\n")); err == nil {
+		t.Errorf("expected a line with missing fields to fail")
+	}
+}
+
+func TestCookieJarSetCookies(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	jar := NewCookieJar()
+	jar.now = func() time.Time { return now }
+	u, _ := url.Parse("https://a.files.example.com/dl/file.bin")
+	jar.SetCookies(u, []*http.Cookie{
+		{Name: "domain", Value: "1", Domain: ".example.com"},
+		{Name: "other", Value: "2", Domain: "example.org"},
+		{Name: "dir", Value: "3"},
+		{Name: "short", Value: "4", MaxAge: 60},
+	})
+
+	get := func(rawURL string) (names []string) {
+		u, _ := url.Parse(rawURL)
+		for _, c := range jar.Cookies(u) {
+			names = append(names, c.Name)
+		}
+		return names
+	}
+	if got := get("https://a.files.example.com/dl/other.bin"); strings.Join(got, " ") != "dir domain short" {
+		t.Errorf("unexpected cookies %q", got)
+	}
+	if got := get("https://b.example.com/dl/file.bin"); strings.Join(got, " ") != "domain" {
+		t.Errorf("unexpected cookies %q", got)
+	}
+
+	// Public suffixes are refused, cookies for them would go to every site.
+	uk, _ := url.Parse("https://files.example.co.uk/")
+	jar.SetCookies(u, []*http.Cookie{{Name: "tld", Value: "5", Domain: "com"}})
+	jar.SetCookies(uk, []*http.Cookie{
+		{Name: "suffix", Value: "6", Domain: ".co.uk"},
+		{Name: "site", Value: "7", Domain: "example.co.uk"},
+	})
+	if got := get("https://other.com/"); len(got) != 0 {
+		t.Errorf("expected no cookies for another site, got %q", got)
+	}
+	if got := get("https://other.co.uk/"); len(got) != 0 {
+		t.Errorf("expected no cookies for another site, got %q", got)
+	}
+	if got := get("https://www.example.co.uk/"); strings.Join(got, " ") != "site" {
+		t.Errorf("unexpected cookies %q", got)
+	}
+	now = now.Add(time.Minute)
+	if got := get("https://a.files.example.com/dl/"); strings.Join(got, " ") != "dir domain" {
+		t.Errorf("expected the short cookie to expire, got %q", got)
+	}
+	jar.SetCookies(u, []*http.Cookie{{Name: "dir", MaxAge: -1}})
+	if got := get("https://a.files.example.com/dl/"); strings.Join(got, " ") != "domain" {
+		t.Errorf("expected the dir cookie to be deleted, got %q", got)
+	}
+}
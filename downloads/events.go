@@ -0,0 +1,196 @@
+package downloads
+
+import (
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type EventType string
+
+const (
+	EventTaskAdded     EventType = "task_added"
+	EventTaskRemoved   EventType = "task_removed"
+	EventStatusChanged EventType = "status_changed"
+	EventProgress      EventType = "progress"
+	EventFileCompleted EventType = "file_completed"
+	EventError         EventType = "error"
+	EventRetry         EventType = "retry"
+)
+
+// progressEventInterval is the minimum time between two progress events of a task.
+var progressEventInterval = 100 * time.Millisecond
+
+// Event describes something that happened to a task. FileId is set for
+// events about a single file, Attempt for retries.
+type Event struct {
+	Type       EventType
+	Time       time.Time
+	TaskId     uuid.UUID
+	FileId     uuid.UUID
+	Status     Status
+	Downloaded int
+	Total      int
+	Err        error
+	Attempt    int
+}
+
+// progressKey identifies the progress events which replace each other.
+type progressKey struct {
+	task, file uuid.UUID
+}
+
+// Subscription delivers the events of a task in the order they happened.
+// Publishing never blocks: events wait in a queue until the subscriber takes
+// them, and a queued progress event is replaced in place by a newer one for
+// the same task unless other events of the task were queued after it.
+type Subscription struct {
+	// C receives the events of a subscription made with Subscribe. It is
+	// closed after Close.
+	C <-chan Event
+
+	hub   *eventHub
+	mu    sync.Mutex
+	queue []Event
+	// head is the sequence number of queue[0], progress maps the progress
+	// events which may still be replaced to their sequence numbers.
+	head     int
+	progress map[progressKey]int
+	wake     chan struct{}
+	done     chan struct{}
+	closed   sync.Once
+}
+
+func (s *Subscription) push(e Event) {
+	s.mu.Lock()
+	key := progressKey{e.TaskId, e.FileId}
+	if e.Type != EventProgress {
+		// A newer progress event must not overtake this one.
+		for k := range s.progress {
+			if k.task == e.TaskId {
+				delete(s.progress, k)
+			}
+		}
+		s.queue = append(s.queue, e)
+	} else if seq, ok := s.progress[key]; ok {
+		s.queue[seq-s.head] = e
+	} else {
+		if s.progress == nil {
+			s.progress = map[progressKey]int{}
+		}
+		s.progress[key] = s.head + len(s.queue)
+		s.queue = append(s.queue, e)
+	}
+	s.mu.Unlock()
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (s *Subscription) pop() (Event, bool) {
+	for {
+		s.mu.Lock()
+		if len(s.queue) > 0 {
+			e := s.queue[0]
+			s.queue = s.queue[1:]
+			key := progressKey{e.TaskId, e.FileId}
+			if seq, ok := s.progress[key]; ok && seq == s.head {
+				delete(s.progress, key)
+			}
+			s.head++
+			s.mu.Unlock()
+			return e, true
+		}
+		s.mu.Unlock()
+		select {
+		case <-s.wake:
+		case <-s.done:
+			return Event{}, false
+		}
+	}
+}
+
+// Close stops the delivery of events. Events still queued are dropped.
+func (s *Subscription) Close() {
+	s.closed.Do(func() {
+		s.hub.unsubscribe(s)
+		close(s.done)
+	})
+}
+
+// eventHub fans events out to its subscriptions.
+type eventHub struct {
+	mu   sync.Mutex
+	subs []*Subscription
+}
+
+func (h *eventHub) subscribe() *Subscription {
+	s := &Subscription{
+		hub:  h,
+		wake: make(chan struct{}, 1),
+		done: make(chan struct{}),
+	}
+	h.mu.Lock()
+	h.subs = append(h.subs, s)
+	h.mu.Unlock()
+	return s
+}
+
+// Subscribe returns a subscription delivering events on its channel.
+func (h *eventHub) Subscribe() *Subscription {
+	s := h.subscribe()
+	ch := make(chan Event)
+	s.C = ch
+	go func() {
+		defer close(ch)
+		for {
+			e, ok := s.pop()
+			if !ok {
+				return
+			}
+			select {
+			case ch <- e:
+			case <-s.done:
+				return
+			}
+		}
+	}()
+	return s
+}
+
+// SubscribeFunc calls fn for every event from a separate goroutine, one
+// event at a time.
+func (h *eventHub) SubscribeFunc(fn func(Event)) *Subscription {
+	s := h.subscribe()
+	go func() {
+		for {
+			e, ok := s.pop()
+			if !ok {
+				return
+			}
+			fn(e)
+		}
+	}()
+	return s
+}
+
+func (h *eventHub) unsubscribe(s *Subscription) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for i, sub := range h.subs {
+		if sub == s {
+			h.subs = append(h.subs[:i], h.subs[i+1:]...)
+			return
+		}
+	}
+}
+
+func (h *eventHub) publish(e Event) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, s := range h.subs {
+		s.push(e)
+	}
+}
@@ -0,0 +1,120 @@
+package downloads
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestSubscriptionCoalescesProgress(t *testing.T) {
+	var hub eventHub
+	sub := hub.Subscribe()
+	defer sub.Close()
+
+	hub.publish(Event{Type: EventStatusChanged, Status: StatusStarted})
+	// Nobody reads while the download reports progress.
+	for i := 1; i <= 1000; i++ {
+		hub.publish(Event{Type: EventProgress, Downloaded: i})
+	}
+	hub.publish(Event{Type: EventStatusChanged, Status: StatusCompleted})
+
+	var events []Event
+	timeout := time.After(time.Second)
+	for len(events) < 3 {
+		select {
+		case e := <-sub.C:
+			events = append(events, e)
+		case <-timeout:
+			t.Fatalf("expected 3 events, got %+v", events)
+		}
+	}
+	// The first event may have been taken before the progress was published.
+	if events[0].Status != StatusStarted || events[1].Downloaded != 1000 || events[2].Status != StatusCompleted {
+		t.Errorf("unexpected events %+v", events)
+	}
+}
+
+func TestSubscriptionCoalescesTasks(t *testing.T) {
+	var hub eventHub
+	release := make(chan struct{})
+	sub := hub.SubscribeFunc(func(Event) { <-release })
+	defer sub.Close()
+
+	// The progress of two tasks alternates while the subscriber is stuck.
+	a, b := uuid.New(), uuid.New()
+	for i := 1; i <= 10000; i++ {
+		hub.publish(Event{Type: EventProgress, TaskId: a, Downloaded: i})
+		hub.publish(Event{Type: EventProgress, TaskId: b, Downloaded: i})
+	}
+	sub.mu.Lock()
+	queued := append([]Event(nil), sub.queue...)
+	sub.mu.Unlock()
+	close(release)
+	if len(queued) > 2 {
+		t.Fatalf("expected at most one progress event per task, got %d", len(queued))
+	}
+	for _, e := range queued {
+		if e.Downloaded != 10000 {
+			t.Errorf("expected the latest progress, got %+v", e)
+		}
+	}
+}
+
+func TestSubscriptionKeepsOrder(t *testing.T) {
+	var hub eventHub
+	sub := hub.Subscribe()
+	defer sub.Close()
+
+	hub.publish(Event{Type: EventProgress, Downloaded: 1})
+	hub.publish(Event{Type: EventStatusChanged, Status: StatusPaused})
+	hub.publish(Event{Type: EventProgress, Downloaded: 2})
+
+	var events []Event
+	timeout := time.After(time.Second)
+	for len(events) < 3 {
+		select {
+		case e := <-sub.C:
+			events = append(events, e)
+		case <-timeout:
+			t.Fatalf("expected 3 events, got %+v", events)
+		}
+	}
+	if events[0].Downloaded != 1 || events[1].Status != StatusPaused || events[2].Downloaded != 2 {
+		t.Errorf("unexpected events %+v", events)
+	}
+}
+
+func TestManagerEvents(t *testing.T) {
+	content := testContent(20000)
+	srv := newTestServer(t, map[string][]byte{"a.bin": content})
+	m := NewManager(t.TempDir(), 1)
+
+	events := make(chan Event, 100)
+	sub := m.SubscribeFunc(func(e Event) { events <- e })
+	defer sub.Close()
+
+	task, err := m.Add(srv.URL + "/a.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	seen := map[EventType]bool{}
+	timeout := time.After(5 * time.Second)
+	for !seen[EventFileCompleted] || task.GetStatus() != StatusCompleted || !seen[EventStatusChanged] {
+		select {
+		case e := <-events:
+			if e.TaskId != task.GetId() {
+				t.Fatalf("event for unknown task %+v", e)
+			}
+			seen[e.Type] = true
+			if e.Type == EventStatusChanged && e.Status == StatusCompleted && e.Downloaded != len(content) {
+				t.Errorf("completed with %d bytes", e.Downloaded)
+			}
+		case <-timeout:
+			t.Fatalf("missing events, got %v", seen)
+		}
+	}
+	if !seen[EventTaskAdded] {
+		t.Errorf("missing %s event", EventTaskAdded)
+	}
+}
@@ -5,15 +5,14 @@ import (
 	"errors"
 	"fmt"
 	"github.com/google/uuid"
-	"golang.org/x/time/rate"
 	"io"
-	"mime"
 	"net/http"
 	"net/url"
 	"os"
-	"path"
 	"regexp"
 	"strconv"
+	"sync"
+	"time"
 )
 
 var contentRangeRe = regexp.MustCompile(`^bytes (?:(?P<range_start>\d+)?-(?P<range_end>\d+)?|\*)(?:/(?P<size>\d+)|/\*$)?`)
@@ -48,7 +47,7 @@ func parseContentRange(s string) (result parseContentRangeResult, err error) {
 	} else {
 		result.rangeEnd = -1
 	}
-	if size, ok := vals["size"]; ok {
+	if size, ok := vals["size"]; ok && size != "" {
 		result.size, _ = strconv.Atoi(size)
 	} else {
 		result.size = -1
@@ -56,29 +55,6 @@ func parseContentRange(s string) (result parseContentRangeResult, err error) {
 	return
 }
 
-type SpeedLimiter struct {
-	*rate.Limiter
-}
-
-func NewSpeedLimiter(bytesPerSec int) *SpeedLimiter {
-	var rateLimit rate.Limit
-	if bytesPerSec == 0 {
-		rateLimit = rate.Inf
-	} else {
-		rateLimit = rate.Limit(bytesPerSec)
-	}
-	return &SpeedLimiter{Limiter: rate.NewLimiter(rateLimit, bytesPerSec)}
-}
-
-func (l *SpeedLimiter) SetLimit(bytesPerSec int) {
-	if bytesPerSec == 0 {
-		l.Limiter.SetLimit(rate.Inf)
-	} else {
-		l.Limiter.SetLimit(rate.Limit(bytesPerSec))
-	}
-	l.Limiter.SetBurst(bytesPerSec)
-}
-
 type FixedLengthReader struct {
 	io.Reader
 	length int
@@ -103,30 +79,6 @@ func (r *FixedLengthReader) Read(p []byte) (n int, err error) {
 	return n, err
 }
 
-type RateLimitedIO struct {
-	reader  io.Reader
-	limiter *SpeedLimiter
-}
-
-func NewRateLimitedIO(reader io.Reader, bytesPerSec int) (*RateLimitedIO, *SpeedLimiter) {
-	limiter := NewSpeedLimiter(bytesPerSec)
-	return &RateLimitedIO{
-		reader:  reader,
-		limiter: limiter,
-	}, limiter
-}
-
-func (r *RateLimitedIO) Read(p []byte) (int, error) {
-	n, err := r.reader.Read(p)
-	if err != nil {
-		return n, err
-	}
-
-	// Wait for permission to read n bytes
-	err = r.limiter.WaitN(context.Background(), n)
-	return n, err
-}
-
 type HttpDownloadFile struct {
 	Id          uuid.UUID
 	Name        string
@@ -139,26 +91,111 @@ type HttpDownloadFile struct {
 	task        *HttpDownloadTask
 	rateLimit   int
 	rateLimiter *SpeedLimiter
-	resumable   bool
-	partSize    int
-	file        *os.File
-	partial     bool
+	// segmentRateLimit caps every connection of the file.
+	segmentRateLimit int
+	resumable        bool
+	partSize         int
+	file             *os.File
+	partial          bool
+	mu               sync.Mutex
+	segments         []*fileSegment
+	running          int
+	// done is closed when the last connection of a start has finished.
+	done chan struct{}
+	// ctx is derived from the task context on every start, cancel closes
+	// every connection of the file.
+	ctx    context.Context
+	cancel context.CancelFunc
+	// checksum is the expected digest of the file, hasher computes the
+	// digest of the downloaded data.
+	checksum *Checksum
+	hasher   *streamHasher
+	// etag and lastModified identify the version of the remote file the
+	// data was downloaded from.
+	etag         string
+	lastModified string
+	// restart is set when the file must be downloaded again from the start
+	// because the remote file changed or the server ignores ranges.
+	restart       bool
+	rangesIgnored bool
+	// skipped is set when the file was completed without downloading it
+	// because a file of the same name existed, which is not its data.
+	skipped bool
 }
 
 func NewHttpDownloadFile(task *HttpDownloadTask, url string) (*HttpDownloadFile, error) {
 	downloadFile := &HttpDownloadFile{
-		Id:        uuid.New(),
-		Path:      task.Path,
-		URL:       url,
-		status:    StatusQueued,
-		task:      task,
-		rateLimit: task.rateLimit,
-	}
-	resp, err := downloadFile.makeHeadRequest()
+		Id:     uuid.New(),
+		Path:   task.Path,
+		URL:    url,
+		status: StatusQueued,
+		task:   task,
+	}
+	resp, err := downloadFile.probe(task.context())
 	if err != nil {
 		return nil, downloadFile.setError(err)
 	}
-	return downloadFile, downloadFile.parseResponse(resp)
+	defer resp.Body.Close()
+	if err := downloadFile.parseResponse(resp); err != nil {
+		return downloadFile, err
+	}
+	return downloadFile, downloadFile.resolveCollision(task.collisionPolicy(), task.nameTaken)
+}
+
+func restoreHttpDownloadFile(task *HttpDownloadTask, s FileState) *HttpDownloadFile {
+	f := &HttpDownloadFile{
+		Id:               s.Id,
+		Name:             s.Name,
+		Downloaded:       s.Downloaded,
+		Total:            s.Total,
+		Path:             s.Path,
+		URL:              s.URL,
+		err:              stringError(s.Error),
+		status:           restoredStatus(s.Status),
+		task:             task,
+		rateLimit:        s.RateLimit,
+		resumable:        s.Resumable,
+		partSize:         s.Total,
+		segmentRateLimit: s.SegmentRateLimit,
+		etag:             s.ETag,
+		lastModified:     s.LastModified,
+		skipped:          s.Skipped,
+	}
+	if s.Checksum != "" {
+		f.checksum, _ = ParseChecksum(s.Checksum)
+	}
+	for _, seg := range s.Segments {
+		f.segments = append(f.segments, &fileSegment{Start: seg.Start, End: seg.End, Downloaded: seg.Downloaded})
+	}
+	return f
+}
+
+func (f *HttpDownloadFile) state() FileState {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	s := FileState{
+		Id:               f.Id,
+		Name:             f.Name,
+		Path:             f.Path,
+		URL:              stripCredentials(f.URL),
+		Downloaded:       f.Downloaded,
+		Total:            f.Total,
+		Status:           f.status,
+		Error:            errorString(f.err),
+		Resumable:        f.resumable,
+		RateLimit:        f.rateLimit,
+		SegmentRateLimit: f.segmentRateLimit,
+		ETag:             f.etag,
+		LastModified:     f.lastModified,
+		Skipped:          f.skipped,
+	}
+	if f.checksum != nil {
+		s.Checksum = f.checksum.String()
+	}
+	for _, seg := range f.segments {
+		s.Segments = append(s.Segments, SegmentState{Start: seg.Start, End: seg.End, Downloaded: seg.Downloaded})
+	}
+	return s
 }
 
 func (f *HttpDownloadFile) GetId() uuid.UUID {
@@ -170,10 +207,16 @@ func (f *HttpDownloadFile) GetName() string {
 }
 
 func (f *HttpDownloadFile) GetDownloaded() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
 	return f.Downloaded
 }
 
+// GetTotal returns the size of the file, UnknownTotal until the end of a
+// download without a Content-Length.
 func (f *HttpDownloadFile) GetTotal() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
 	return f.Total
 }
 
@@ -181,165 +224,624 @@ func (f *HttpDownloadFile) GetPath() string {
 	return f.Path
 }
 
+func (f *HttpDownloadFile) getStatus() Status {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.status
+}
+
 func (f *HttpDownloadFile) setError(err error) error {
 	f.err = err
-	if err != nil {
+	if errors.Is(err, ErrChecksumMismatch) {
+		f.status = StatusChecksumMismatch
+	} else if err != nil {
 		f.status = StatusFailed
 	}
 	return err
 }
 
-func (f *HttpDownloadFile) download(resp *http.Response) error {
+// download copies the body of resp into the range of segment s until the
+// range is complete, the file stops being started or the request context
+// is cancelled.
+func (f *HttpDownloadFile) download(s *fileSegment, resp *http.Response) error {
 	defer resp.Body.Close()
-	var r io.Reader
-	r = NewFixedLengthReader(resp.Body, f.Total-f.Downloaded)
-	r, f.rateLimiter = NewRateLimitedIO(r, f.rateLimit)
+	ctx := resp.Request.Context()
+	f.mu.Lock()
+	if s.limiter == nil {
+		s.limiter = newChildSpeedLimiter(f.rateLimiter, f.segmentRateLimit)
+	}
+	r := &RateLimitedIO{ctx: ctx, reader: resp.Body, limiter: s.limiter}
+	f.mu.Unlock()
 
 	b := make([]byte, 1024)
 
-	for f.status == StatusStarted {
-		n, err := r.Read(b)
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		f.mu.Lock()
+		remaining := s.remaining()
+		started := f.status == StatusStarted
+		f.mu.Unlock()
+		if !started || remaining <= 0 {
+			return nil
+		}
+		n, err := r.Read(b[:min(len(b), remaining)])
+		if n > 0 {
+			f.mu.Lock()
+			// The range may have shrunk while reading.
+			n = min(n, s.remaining())
+			offset := s.offset()
+			f.mu.Unlock()
+			if _, err := f.file.WriteAt(b[:n], int64(offset)); err != nil {
+				return err
+			}
+			f.mu.Lock()
+			n = min(n, s.remaining())
+			s.Downloaded += n
+			f.Downloaded += n
+			remaining = s.remaining()
+			f.mu.Unlock()
+			if err := f.hash(s, offset, b[:n]); err != nil {
+				return err
+			}
+			f.task.onProgress()
+		}
 		if errors.Is(err, io.EOF) {
-			f.status = StatusCompleted
-			f.task.onFileCompleted(f)
+			f.mu.Lock()
+			if f.Total == UnknownTotal {
+				// A clean EOF is the end of a file of unknown size.
+				s.End = s.offset()
+				f.Total = f.Downloaded
+				remaining = 0
+			}
+			f.mu.Unlock()
+			if remaining > 0 {
+				return io.ErrUnexpectedEOF
+			}
 			return nil
 		} else if err != nil {
 			return err
 		}
-		if _, err := f.file.Write(b[:n]); err != nil {
-			return err
-		}
-		f.Downloaded += n
 	}
-	return nil
 }
 
-func (f *HttpDownloadFile) setRateLimit(limit int) {
-	f.rateLimit = limit
+// SetRateLimit caps the download speed of the file in bytes per second.
+// Zero removes the cap. It also counts against the limits of the task and
+// of the manager.
+func (f *HttpDownloadFile) SetRateLimit(bytesPerSec int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.rateLimit = bytesPerSec
 	if f.rateLimiter != nil {
-		f.rateLimiter.SetLimit(limit)
+		f.rateLimiter.SetLimit(bytesPerSec)
+	}
+}
+
+func (f *HttpDownloadFile) GetRateLimit() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.rateLimit
+}
+
+// SetSegmentRateLimit caps the speed of every connection of the file in
+// bytes per second. Zero removes the cap.
+func (f *HttpDownloadFile) SetSegmentRateLimit(bytesPerSec int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.segmentRateLimit = bytesPerSec
+	for _, s := range f.segments {
+		if s.limiter != nil {
+			s.limiter.SetLimit(bytesPerSec)
+		}
 	}
 }
 
-func (f *HttpDownloadFile) startDownload(resp *http.Response) error {
+func (f *HttpDownloadFile) GetSegmentRateLimit() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.segmentRateLimit
+}
 
+// startDownload downloads segment s, using resp when the request for it
+// has already been made with a context cancelled by cancel. Transient
+// failures are retried according to the retry policy of the task. When the
+// segment is done the connection takes over part of the largest range
+// still being downloaded.
+func (f *HttpDownloadFile) startDownload(s *fileSegment, resp *http.Response, cancel context.CancelFunc) {
+	var err error
 	defer func() {
-		if err := recover(); err != nil {
-			f.setError(err.(error))
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%v", r)
 		}
+		f.segmentFinished(s, err)
 	}()
-	return f.setError(f.download(resp))
+	// progress is the most of the segment downloaded so far. Attempts only
+	// count while it doesn't grow, as a file that can't be resumed may
+	// fail at the same point again and again.
+	attempt, progress := 0, f.segmentDownloaded(s)
+	for {
+		if resp == nil {
+			resp, cancel, err = f.requestSegment(s)
+		} else {
+			f.mu.Lock()
+			s.connect(cancel)
+			f.mu.Unlock()
+		}
+		if err == nil {
+			err = f.download(s, resp)
+		}
+		cancel()
+		resp = nil
+		if f.takeDropped(s) {
+			err = nil
+			continue
+		}
+		if err != nil {
+			if downloaded := f.segmentDownloaded(s); downloaded > progress {
+				progress = downloaded
+				attempt = 0
+			}
+			attempt++
+			if f.retry(err, attempt) {
+				err = nil
+				continue
+			}
+			return
+		}
+		next := f.steal(s)
+		if next == nil {
+			return
+		}
+		s = next
+		attempt, progress = 0, f.segmentDownloaded(s)
+	}
 }
 
-func (f *HttpDownloadFile) makePartialRequest() (*http.Response, error) {
-	req, err := http.NewRequest("GET", f.URL, nil)
+// requestSegment opens a new connection for the rest of segment s. The
+// returned cancel func closes it.
+func (f *HttpDownloadFile) requestSegment(s *fileSegment) (*http.Response, context.CancelFunc, error) {
+	ctx, cancel, err := f.openConnection()
+	if err != nil {
+		return nil, cancel, err
+	}
+	f.mu.Lock()
+	s.connect(cancel)
+	resumable := f.resumable
+	if !resumable {
+		// Without range support the only way to continue is to start over.
+		f.Downloaded -= s.Downloaded
+		s.Downloaded = 0
+		f.resetHasher()
+	}
+	file := f.file
+	f.mu.Unlock()
+	if !resumable {
+		// A shorter response must not leave the tail of the previous one.
+		if file != nil {
+			if err := file.Truncate(0); err != nil {
+				return nil, cancel, err
+			}
+		}
+		resp, err := f.makeRequest(ctx)
+		if err == nil {
+			err = checkStatus(resp)
+		}
+		return resp, cancel, err
+	}
+	policy, fallback := f.task.GetChangePolicy(), f.task.GetRangeFallback()
+	resp, err := f.makePartialRequest(ctx, s)
+	if err != nil {
+		return nil, cancel, err
+	}
+	skip := 0
+	f.mu.Lock()
+	err = f.checkUnchanged(resp)
+	switch {
+	case err != nil:
+		if policy == ChangePolicyRestart {
+			f.restart = true
+			f.cancel()
+		}
+	case resp.StatusCode == http.StatusOK && fallback == RangeFallbackSkip:
+		skip = s.offset()
+	case resp.StatusCode == http.StatusOK:
+		f.ignoreRanges()
+		err = errRangeIgnored
+	default:
+		err = f.parsePartialResponse(resp, s.offset())
+	}
+	f.mu.Unlock()
+	if err == nil && skip > 0 {
+		_, err = io.CopyN(io.Discard, resp.Body, int64(skip))
+	}
+	if err != nil {
+		resp.Body.Close()
+		return nil, cancel, err
+	}
+	return resp, cancel, nil
+}
+
+// host returns the host connections of the file are counted against.
+func (f *HttpDownloadFile) host() string {
+	u, err := url.Parse(f.URL)
+	if err != nil {
+		return f.URL
+	}
+	return u.Host
+}
+
+// openConnection waits until the host of the file accepts another
+// connection and returns the context of the new connection. Cancelling it
+// closes the connection and frees its slot.
+func (f *HttpDownloadFile) openConnection() (context.Context, context.CancelFunc, error) {
+	ctx, cancel := context.WithCancel(f.ctx)
+	hosts, host := f.task.hosts(), f.host()
+	if err := hosts.acquire(ctx, host); err != nil {
+		return ctx, cancel, err
+	}
+	var once sync.Once
+	return ctx, func() {
+		cancel()
+		once.Do(func() { hosts.release(host) })
+	}, nil
+}
+
+// segmentFinished is called by every segment download when it stops. The
+// last one to stop closes the file and reports the result to the task.
+func (f *HttpDownloadFile) segmentFinished(s *fileSegment, err error) {
+	ctx := f.task.context()
+	f.mu.Lock()
+	if s != nil {
+		s.active = false
+	}
+	// Errors caused by cancelling the file context aren't failures.
+	if err != nil && f.status == StatusStarted && f.ctx.Err() == nil {
+		f.setError(err)
+	}
+	f.running--
+	if f.running > 0 {
+		f.mu.Unlock()
+		return
+	}
+	if f.status == StatusStarted && f.restart {
+		f.restart = false
+		f.Downloaded = 0
+		f.segments = nil
+		f.resetHasher()
+		if f.file != nil {
+			f.file.Close()
+			f.file = nil
+		}
+		f.cancel()
+		f.launch(ctx)
+		f.mu.Unlock()
+		f.task.onProgress()
+		return
+	}
+	if f.status == StatusStarted && f.segmentsCompleted() {
+		if err := f.verify(); err != nil {
+			f.setError(err)
+		} else if err := f.commit(); err != nil {
+			f.setError(err)
+		} else {
+			f.status = StatusCompleted
+		}
+	}
+	status := f.status
+	if f.file != nil {
+		f.file.Close()
+		f.file = nil
+	}
+	f.cancel()
+	close(f.done)
+	f.mu.Unlock()
+
+	switch status {
+	case StatusCompleted:
+		f.task.onFileCompleted(f)
+	case StatusFailed, StatusChecksumMismatch:
+		f.task.onFileFailed(f)
+	}
+}
+
+func (f *HttpDownloadFile) makePartialRequest(ctx context.Context, s *fileSegment) (*http.Response, error) {
+	client := f.task.httpClient()
+	req, err := client.newRequest(ctx, http.MethodGet, f.URL)
 	if err != nil {
 		return nil, err
 	}
-	req.Header.Set("Range", fmt.Sprintf("bytes=%d-", f.Downloaded))
-	return http.DefaultClient.Do(req)
+	f.mu.Lock()
+	if s.End >= f.Total {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", s.offset()))
+	} else {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", s.offset(), s.End-1))
+	}
+	if validator := f.ifRange(); validator != "" {
+		req.Header.Set("If-Range", validator)
+	}
+	f.mu.Unlock()
+	return client.do(req)
 }
 
-func (f *HttpDownloadFile) makeRequest() (*http.Response, error) {
-	req, err := http.NewRequest("GET", f.URL, nil)
+func (f *HttpDownloadFile) makeRequest(ctx context.Context) (*http.Response, error) {
+	client := f.task.httpClient()
+	req, err := client.newRequest(ctx, http.MethodGet, f.URL)
 	if err != nil {
 		return nil, err
 	}
-	return http.DefaultClient.Do(req)
+	return client.do(req)
 }
 
-func (f *HttpDownloadFile) makeHeadRequest() (*http.Response, error) {
-	req, err := http.NewRequest("HEAD", f.URL, nil)
+func (f *HttpDownloadFile) makeHeadRequest(ctx context.Context) (*http.Response, error) {
+	client := f.task.httpClient()
+	req, err := client.newRequest(ctx, http.MethodHead, f.URL)
 	if err != nil {
 		return nil, err
 	}
-	return http.DefaultClient.Do(req)
+	return client.do(req)
 }
 
-func (f *HttpDownloadFile) parsePartialResponse(resp *http.Response) error {
+// parsePartialResponse checks that resp holds the range starting at offset.
+// f.mu must be held.
+func (f *HttpDownloadFile) parsePartialResponse(resp *http.Response, offset int) error {
 	if resp.StatusCode != http.StatusPartialContent {
-		return fmt.Errorf("http download failed with status code %d", resp.StatusCode)
+		return newStatusError(resp)
 	}
 	parseResult, err := parseContentRange(resp.Header.Get("Content-Range"))
 	if err != nil {
 		return err
 	}
+	if parseResult.rangeStart != offset {
+		return fmt.Errorf("server returned range starting at %d instead of %d", parseResult.rangeStart, offset)
+	}
 	f.Total = parseResult.size
 	return nil
 }
 
-func (f *HttpDownloadFile) parseResponse(resp *http.Response) error {
-	if resp.StatusCode != http.StatusPartialContent {
-		return f.parsePartialResponse(resp)
-	}
+// checkStatus returns a StatusError and closes the body unless resp is successful.
+func checkStatus(resp *http.Response) error {
 	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
-		return fmt.Errorf("http download failed with status code %d", resp.StatusCode)
+		resp.Body.Close()
+		return newStatusError(resp)
 	}
-	if cd := resp.Header.Get("Content-Disposition"); cd != "" {
-		if _, params, err := mime.ParseMediaType(cd); err == nil {
-			f.Name = params["filename"]
+	return nil
+}
+
+func (f *HttpDownloadFile) parseResponse(resp *http.Response) error {
+	if resp.StatusCode == http.StatusPartialContent {
+		// The answer to a request of the first byte.
+		if err := f.parsePartialResponse(resp, 0); err != nil {
+			return err
 		}
-	}
-	if f.Path == "" {
-		parsedURL, err := url.Parse(f.URL)
-		if err != nil {
-			return fmt.Errorf("failed to parse url: %s", err)
+		f.resumable = true
+	} else {
+		if err := checkStatus(resp); err != nil {
+			return err
+		}
+		f.Total = int(resp.ContentLength)
+		if resp.Header.Get("Accept-Ranges") == "bytes" && !f.rangesIgnored {
+			f.resumable = true
 		}
-		f.Name = path.Base(parsedURL.Path)
 	}
-	if resp.Header.Get("Accept-Ranges") == "bytes" {
-		f.resumable = true
+	if f.Name == "" {
+		f.Name = responseFileName(resp)
+	}
+	if f.checksum == nil {
+		f.checksum = responseChecksum(resp)
+	}
+	f.etag = resp.Header.Get("ETag")
+	f.lastModified = resp.Header.Get("Last-Modified")
+	if f.Total < 0 {
+		// The file is streamed until EOF, there is no range to resume from.
+		f.Total = UnknownTotal
+		f.resumable = false
 	}
-	f.Total = int(resp.ContentLength)
 	f.Downloaded = 0
 	f.partSize = f.Total
 	return nil
 }
 
 func (f *HttpDownloadFile) makeFile() error {
-	file, err := os.OpenFile(f.Path+"/"+f.Name, os.O_WRONLY|os.O_CREATE, 0666)
+	file, err := f.openFile(f.partName(), os.O_RDWR|os.O_CREATE)
 	if err != nil {
 		return err
 	}
-	if _, err := file.Seek(int64(f.Downloaded), io.SeekStart); err != nil {
-		return err
-	}
+	f.mu.Lock()
 	f.file = file
+	f.mu.Unlock()
 	return nil
 }
 
+// removeData deletes the staging file of the file from disk, and the
+// completed file too when complete is set.
+func (f *HttpDownloadFile) removeData(complete bool) error {
+	if f.Name == "" || f.skipped {
+		return nil
+	}
+	names := []string{f.partName()}
+	if complete {
+		names = append(names, f.Name)
+	}
+	for _, name := range names {
+		if err := f.removeFile(name); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+// start downloads the file in the background, resuming from the saved
+// segments when possible.
+func (f *HttpDownloadFile) start() {
+	ctx := f.task.context()
+	f.mu.Lock()
+	if f.status == StatusChecksumMismatch {
+		// The data on disk is corrupted, download it again.
+		f.Downloaded = 0
+		f.segments = nil
+		f.hasher = nil
+	}
+	if f.hasher == nil {
+		f.resetHasher()
+	}
+	f.status = StatusStarted
+	f.err = nil
+	if f.rateLimiter == nil {
+		f.rateLimiter = newChildSpeedLimiter(f.task.limiter, f.rateLimit)
+	}
+	f.done = make(chan struct{})
+	f.launch(ctx)
+	f.mu.Unlock()
+}
+
+// launch downloads the file in the background, connections are derived
+// from ctx, the task context. f.mu must be held, and as the task context
+// is guarded by dt.mu it must be read before locking f.mu.
+func (f *HttpDownloadFile) launch(ctx context.Context) {
+	f.running = 1
+	f.ctx, f.cancel = context.WithCancel(ctx)
+	go func() {
+		var err error
+		defer func() {
+			if r := recover(); r != nil {
+				err = fmt.Errorf("%v", r)
+			}
+			f.segmentFinished(nil, err)
+		}()
+		for attempt := 1; ; attempt++ {
+			if err = f.resumeDownloading(); err == nil || !f.retry(err, attempt) {
+				return
+			}
+		}
+	}()
+}
+
+// halt stops a started file, switching it to status, and waits until every
+// connection has been closed.
+func (f *HttpDownloadFile) halt(status Status) {
+	f.mu.Lock()
+	if f.status != StatusStarted {
+		if f.status != StatusCompleted {
+			f.status = status
+		}
+		f.mu.Unlock()
+		return
+	}
+	f.status = status
+	f.cancel()
+	done := f.done
+	f.mu.Unlock()
+	<-done
+}
+
+// wait blocks until the connections of the last start have been closed.
+func (f *HttpDownloadFile) wait() {
+	f.mu.Lock()
+	done := f.done
+	f.mu.Unlock()
+	if done != nil {
+		<-done
+	}
+}
+
+// reset discards the progress of the file so the next start downloads it from scratch.
+func (f *HttpDownloadFile) reset() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.status = StatusQueued
+	f.err = nil
+	f.Downloaded = 0
+	f.segments = nil
+	f.hasher = nil
+}
+
+// run starts a download for every unfinished segment. The first one reuses
+// resp when it is not nil, cancel closes its connection.
+func (f *HttpDownloadFile) run(resp *http.Response, cancel context.CancelFunc) {
+	segmented := f.task.GetSegmentCount() > 1
+	f.mu.Lock()
+	if f.status != StatusStarted {
+		f.mu.Unlock()
+		if resp != nil {
+			resp.Body.Close()
+			cancel()
+		}
+		return
+	}
+	var pending []*fileSegment
+	for _, s := range f.segments {
+		if s.remaining() > 0 {
+			s.active = true
+			pending = append(pending, s)
+		}
+	}
+	f.running += len(pending)
+	if f.resumable && segmented {
+		go f.monitorSegments(segmentCheckInterval, f.done)
+	}
+	f.mu.Unlock()
+	for i, s := range pending {
+		if i == 0 && resp != nil {
+			go f.startDownload(s, resp, cancel)
+		} else {
+			go f.startDownload(s, nil, nil)
+		}
+	}
+}
+
 func (f *HttpDownloadFile) startDownloading() error {
-	resp, err := f.makeRequest()
+	ctx, cancel, err := f.openConnection()
 	if err != nil {
+		cancel()
 		return err
 	}
-	if err := f.parseResponse(resp); err != nil {
+	resp, err := f.makeRequest(ctx)
+	if err != nil {
+		cancel()
 		return err
 	}
-	if err := f.makeFile(); err != nil {
+	count := f.task.GetSegmentCount()
+	f.mu.Lock()
+	err = f.parseResponse(resp)
+	if err == nil {
+		f.makeSegments(count)
+		f.resetHasher()
+	}
+	f.mu.Unlock()
+	if err == nil {
+		err = f.makeFile()
+	}
+	if err == nil {
+		// Nothing of an earlier download of the file may be left over.
+		err = f.file.Truncate(0)
+	}
+	if err != nil {
+		resp.Body.Close()
+		cancel()
 		return err
 	}
-	f.status = StatusStarted
-	go f.startDownload(resp)
+	f.run(resp, cancel)
 	return nil
 }
 
 func (f *HttpDownloadFile) resumeDownloading() error {
-	if !f.resumable || f.Downloaded == 0 {
+	if !f.resumable || f.GetDownloaded() == 0 || !f.staged() {
 		return f.startDownloading()
 	}
-	resp, err := f.makePartialRequest()
-	if err != nil {
-		return err
+	f.mu.Lock()
+	if len(f.segments) == 0 {
+		f.segments = []*fileSegment{{Start: 0, End: f.Total, Downloaded: f.Downloaded}}
 	}
-	if err := f.parseResponse(resp); err != nil {
-		return err
+	completed := f.segmentsCompleted()
+	f.mu.Unlock()
+	if completed {
+		return nil
 	}
 	if err := f.makeFile(); err != nil {
 		return err
 	}
-	f.status = StatusStarted
-	go f.startDownload(resp)
+	f.run(nil, nil)
 	return nil
 }
 
@@ -354,6 +856,123 @@ type HttpDownloadTask struct {
 	Path       string
 	ctx        context.Context
 	rateLimit  int
+	// limiter caps the task at rateLimit, its files' limiters are its
+	// children. Its parent share caps the task at its part of the manager
+	// limit, which is proportional to weight.
+	limiter *SpeedLimiter
+	share   *SpeedLimiter
+	weight  int
+	manager *Manager
+	// client overrides the HTTP client of the manager when set.
+	client *httpClient
+	// mu guards Status, Error, ctx, manager and segmentCount, opMu
+	// serializes the lifecycle operations, which may wait for connections
+	// to close.
+	mu   sync.Mutex
+	opMu sync.Mutex
+	// segmentCount is the number of connections each file is downloaded over.
+	segmentCount int
+	events       eventHub
+	// retryPolicy overrides the policy of the manager when set.
+	retryPolicy   *RetryPolicy
+	changePolicy  ChangePolicy
+	rangeFallback RangeFallback
+	// lastProgressEvent throttles progress events.
+	lastProgressEvent time.Time
+}
+
+func NewHttpDownloadTask(path string, urls ...string) (*HttpDownloadTask, error) {
+	return NewHttpDownloadTaskWithContext(context.Background(), path, urls...)
+}
+
+// NewHttpDownloadTaskWithContext creates a task whose requests, including
+// the initial HEAD requests, are cancelled when ctx is done.
+func NewHttpDownloadTaskWithContext(ctx context.Context, path string, urls ...string) (*HttpDownloadTask, error) {
+	return newHttpDownloadTask(ctx, nil, nil, path, urls)
+}
+
+// NewHttpDownloadTaskWithClient creates a task whose requests, including the
+// initial HEAD requests, are made with the client described by c.
+func NewHttpDownloadTaskWithClient(ctx context.Context, c ClientConfig, path string, urls ...string) (*HttpDownloadTask, error) {
+	return newHttpDownloadTask(ctx, nil, newHttpClient(c), path, urls)
+}
+
+// newHttpDownloadTask creates a task of manager m when it isn't nil, so the
+// initial requests use the client of m unless client is set.
+func newHttpDownloadTask(ctx context.Context, m *Manager, client *httpClient, path string, urls []string) (*HttpDownloadTask, error) {
+	if len(urls) == 0 {
+		return nil, errors.New("no urls to download")
+	}
+	task := &HttpDownloadTask{
+		Id:           uuid.New(),
+		Path:         path,
+		Status:       StatusQueued,
+		ctx:          ctx,
+		limiter:      NewSpeedLimiter(0),
+		share:        NewSpeedLimiter(0),
+		weight:       DefaultWeight,
+		segmentCount: 1,
+		client:       client,
+	}
+	if m != nil {
+		task.setManager(m)
+	}
+	for _, u := range urls {
+		file, err := NewHttpDownloadFile(task, u)
+		if err != nil {
+			return nil, err
+		}
+		task.Files = append(task.Files, file)
+	}
+	task.Name = task.Files[0].Name
+	return task, nil
+}
+
+// restoreHttpDownloadTask rebuilds a task saved by a previous process.
+// Files are resumed from their saved offsets without a new HEAD request.
+func restoreHttpDownloadTask(s TaskState) *HttpDownloadTask {
+	task := &HttpDownloadTask{
+		Id:            s.Id,
+		Name:          s.Name,
+		Status:        restoredStatus(s.Status),
+		Error:         stringError(s.Error),
+		Path:          s.Path,
+		ctx:           context.Background(),
+		rateLimit:     s.RateLimit,
+		limiter:       NewSpeedLimiter(s.RateLimit),
+		share:         NewSpeedLimiter(0),
+		weight:        max(s.Weight, 1),
+		segmentCount:  max(s.Segments, 1),
+		changePolicy:  s.ChangePolicy,
+		rangeFallback: s.RangeFallback,
+	}
+	for _, fs := range s.Files {
+		task.Files = append(task.Files, restoreHttpDownloadFile(task, fs))
+	}
+	return task
+}
+
+func (dt *HttpDownloadTask) state() TaskState {
+	dt.mu.Lock()
+	s := TaskState{
+		Id:            dt.Id,
+		Type:          dt.GetType(),
+		Name:          dt.Name,
+		Path:          dt.Path,
+		Status:        dt.Status,
+		Error:         errorString(dt.Error),
+		RateLimit:     dt.rateLimit,
+		Weight:        dt.weight,
+		ChangePolicy:  dt.changePolicy,
+		RangeFallback: dt.rangeFallback,
+		Segments:      dt.segmentCount,
+	}
+	dt.mu.Unlock()
+	// Files take f.mu, which is never locked inside dt.mu.
+	for _, file := range dt.Files {
+		s.Files = append(s.Files, file.state())
+	}
+	return s
 }
 
 func (dt *HttpDownloadTask) GetId() uuid.UUID {
@@ -375,74 +994,397 @@ func (dt *HttpDownloadTask) GetName() string {
 	return dt.Name
 }
 
-func (dt *HttpDownloadTask) GetDownloaded() int {
-	return dt.Downloaded
+func (dt *HttpDownloadTask) GetDownloaded() (downloaded int) {
+	for _, file := range dt.Files {
+		downloaded += file.GetDownloaded()
+	}
+	return downloaded
 }
 
-func (dt *HttpDownloadTask) GetTotal() int {
-	return dt.Total
+// GetTotal returns the size of the files of the task, UnknownTotal while
+// the size of any of them isn't known.
+func (dt *HttpDownloadTask) GetTotal() (total int) {
+	for _, file := range dt.Files {
+		size := file.GetTotal()
+		if size == UnknownTotal {
+			return UnknownTotal
+		}
+		total += size
+	}
+	return total
 }
 
 func (dt *HttpDownloadTask) GetStatus() Status {
+	dt.mu.Lock()
+	defer dt.mu.Unlock()
 	return dt.Status
 }
 
 func (dt *HttpDownloadTask) GetError() error {
+	dt.mu.Lock()
+	defer dt.mu.Unlock()
 	return dt.Error
 }
 
-func (dt *HttpDownloadTask) GetPath() error {
-	return dt.Error
+func (dt *HttpDownloadTask) GetPath() string {
+	return dt.Path
+}
+
+// SetRateLimit caps the download speed of the task in bytes per second.
+// Zero removes the cap. It also counts against the limit of the manager.
+func (dt *HttpDownloadTask) SetRateLimit(bytesPerSec int) {
+	dt.mu.Lock()
+	defer dt.mu.Unlock()
+	dt.rateLimit = bytesPerSec
+	dt.limiter.SetLimit(bytesPerSec)
+	if dt.manager != nil {
+		dt.manager.rebalanceLater()
+	}
+}
+
+func (dt *HttpDownloadTask) GetRateLimit() int {
+	dt.mu.Lock()
+	defer dt.mu.Unlock()
+	return dt.rateLimit
+}
+
+// SetWeight sets the weight of the task. Started tasks share the rate limit
+// of their manager in proportion to their weights, so a task with weight 3
+// downloads three times faster than one with DefaultWeight.
+func (dt *HttpDownloadTask) SetWeight(weight int) {
+	dt.mu.Lock()
+	defer dt.mu.Unlock()
+	dt.weight = max(weight, 1)
+	if dt.manager != nil {
+		dt.manager.rebalanceLater()
+	}
+}
+
+func (dt *HttpDownloadTask) GetWeight() int {
+	dt.mu.Lock()
+	defer dt.mu.Unlock()
+	return dt.weight
+}
+
+func (dt *HttpDownloadTask) setShare(bytesPerSec int) {
+	dt.share.SetLimit(bytesPerSec)
+}
+
+// SetSegmentCount sets the number of parallel connections used for files
+// that support range requests. It applies the next time a file is started.
+func (dt *HttpDownloadTask) SetSegmentCount(n int) {
+	dt.mu.Lock()
+	defer dt.mu.Unlock()
+	dt.segmentCount = max(n, 1)
+}
+
+func (dt *HttpDownloadTask) GetSegmentCount() int {
+	dt.mu.Lock()
+	defer dt.mu.Unlock()
+	return dt.segmentCount
+}
+
+// SetRetryPolicy sets the retry policy of the task. A nil policy falls back
+// to the policy of the manager or DefaultRetryPolicy.
+func (dt *HttpDownloadTask) SetRetryPolicy(p *RetryPolicy) {
+	dt.mu.Lock()
+	defer dt.mu.Unlock()
+	dt.retryPolicy = p
+}
+
+func (dt *HttpDownloadTask) getRetryPolicy() RetryPolicy {
+	dt.mu.Lock()
+	policy, m := dt.retryPolicy, dt.manager
+	dt.mu.Unlock()
+	if policy != nil {
+		return *policy
+	}
+	if m != nil {
+		return m.GetRetryPolicy()
+	}
+	return DefaultRetryPolicy
+}
+
+// hosts returns the connection counter shared with the other tasks of the manager.
+func (dt *HttpDownloadTask) hosts() *hostThrottle {
+	dt.mu.Lock()
+	defer dt.mu.Unlock()
+	if dt.manager != nil {
+		return dt.manager.hosts
+	}
+	return defaultHostThrottle
+}
+
+// setStatus moves the task to status if the transition is allowed, p is
+// the progress reported with the change. dt.mu must be held.
+func (dt *HttpDownloadTask) setStatus(status Status, p taskProgress) error {
+	if !dt.Status.CanTransition(status) {
+		return &TransitionError{From: dt.Status, To: status}
+	}
+	dt.Status = status
+	dt.emitLocked(Event{Type: EventStatusChanged}, p)
+	if dt.manager != nil {
+		dt.manager.rebalanceLater()
+	}
+	return nil
+}
+
+// canTransition reports why the task can't move to status, if it can't.
+// Stop and requeue check it before closing the connections and only move
+// the task to the queue afterwards, so the manager doesn't start it again
+// while it is still stopping.
+func (dt *HttpDownloadTask) canTransition(status Status) error {
+	dt.mu.Lock()
+	defer dt.mu.Unlock()
+	if !dt.Status.CanTransition(status) {
+		return &TransitionError{From: dt.Status, To: status}
+	}
+	return nil
+}
+
+// transition validates and applies a status change requested by the user.
+func (dt *HttpDownloadTask) transition(status Status) error {
+	p := dt.progress()
+	dt.mu.Lock()
+	defer dt.mu.Unlock()
+	return dt.setStatus(status, p)
+}
+
+// wait blocks until the connections of every file have been closed.
+func (dt *HttpDownloadTask) wait() {
+	for _, file := range dt.Files {
+		file.wait()
+	}
+}
+
+// halt stops every file of the task, switching the started ones to status.
+func (dt *HttpDownloadTask) halt(status Status) {
+	for _, file := range dt.Files {
+		file.halt(status)
+	}
 }
 
+// Pause closes the connections of the task, keeping the downloaded data and
+// offsets so Start resumes where it stopped.
 func (dt *HttpDownloadTask) Pause() error {
-	//TODO implement me
-	panic("implement me")
+	dt.opMu.Lock()
+	defer dt.opMu.Unlock()
+	if err := dt.transition(StatusPaused); err != nil {
+		return err
+	}
+	dt.halt(StatusPaused)
+	dt.notifyManager()
+	return nil
 }
 
-func (dt *HttpDownloadTask) _start() (err error) {
+// _start starts the first file which isn't completed yet or completes the
+// task when there are none. dt.opMu must be held.
+func (dt *HttpDownloadTask) _start() {
 	for _, file := range dt.Files {
-		if file.status != StatusCompleted {
-			if dt.Status == StatusPaused {
-				err = file.resumeDownloading()
-			} else {
-				err = file.startDownloading()
-			}
-			if err != nil {
-				dt.Status = StatusCompleted
-				dt.Error = err
-			} else {
-				dt.Status = StatusStarted
-			}
-			return
+		if file.getStatus() == StatusCompleted {
+			continue
 		}
+		file.start()
+		return
 	}
-	dt.Status = StatusCompleted
-	return nil
+	p := dt.progress()
+	dt.mu.Lock()
+	dt.setStatus(StatusCompleted, p)
+	dt.mu.Unlock()
+	dt.notifyManager()
 }
 
 func (dt *HttpDownloadTask) Start() error {
-	if dt.Status != StatusStarted && dt.Status != StatusCompleted {
-		return dt._start()
+	dt.opMu.Lock()
+	defer dt.opMu.Unlock()
+	p := dt.progress()
+	dt.mu.Lock()
+	err := dt.setStatus(StatusStarted, p)
+	if err == nil {
+		dt.Error = nil
+	}
+	dt.mu.Unlock()
+	if err != nil {
+		return err
 	}
+	dt._start()
 	return nil
 }
 
+// requeue closes the connections of a started task and puts it back in the
+// queue, keeping its progress so it resumes when started again.
+func (dt *HttpDownloadTask) requeue() error {
+	dt.opMu.Lock()
+	defer dt.opMu.Unlock()
+	if err := dt.canTransition(StatusQueued); err != nil {
+		return err
+	}
+	dt.halt(StatusQueued)
+	return dt.transition(StatusQueued)
+}
+
+// Stop closes the connections of the task, discards its progress and puts
+// it back in the queue to be downloaded from scratch.
 func (dt *HttpDownloadTask) Stop() error {
-	//TODO implement me
-	panic("implement me")
+	dt.opMu.Lock()
+	defer dt.opMu.Unlock()
+	if err := dt.canTransition(StatusQueued); err != nil {
+		return err
+	}
+	dt.halt(StatusQueued)
+	for _, file := range dt.Files {
+		file.reset()
+	}
+	dt.mu.Lock()
+	dt.Error = nil
+	dt.mu.Unlock()
+	if err := dt.transition(StatusQueued); err != nil {
+		return err
+	}
+	dt.notifyManager()
+	return nil
 }
 
+func (dt *HttpDownloadTask) delete(withData bool) error {
+	dt.opMu.Lock()
+	defer dt.opMu.Unlock()
+	if err := dt.transition(StatusDeleted); err != nil {
+		return err
+	}
+	dt.halt(StatusDeleted)
+	var errs []error
+	for _, file := range dt.Files {
+		errs = append(errs, file.removeData(withData))
+	}
+	dt.mu.Lock()
+	m := dt.manager
+	dt.mu.Unlock()
+	if m != nil {
+		m.forget(dt)
+	}
+	return errors.Join(errs...)
+}
+
+// Delete stops the task and drops it from its manager. Completed files are
+// kept, the staging files of the others are removed.
 func (dt *HttpDownloadTask) Delete() error {
-	//TODO implement me
-	panic("implement me")
+	return dt.delete(false)
 }
 
+// DeleteWithData stops the task, drops it from its manager and removes the
+// downloaded files, partial or complete.
 func (dt *HttpDownloadTask) DeleteWithData() error {
-	//TODO implement me
-	panic("implement me")
+	return dt.delete(true)
 }
 
 func (dt *HttpDownloadTask) onFileCompleted(f *HttpDownloadFile) {
-	dt._start()
+	dt.emit(Event{Type: EventFileCompleted, FileId: f.Id})
+	dt.opMu.Lock()
+	defer dt.opMu.Unlock()
+	if dt.GetStatus() == StatusStarted {
+		dt._start()
+	}
+}
+
+func (dt *HttpDownloadTask) onFileFailed(f *HttpDownloadFile) {
+	status := StatusFailed
+	if errors.Is(f.err, ErrChecksumMismatch) {
+		status = StatusChecksumMismatch
+	}
+	p := dt.progress()
+	dt.mu.Lock()
+	if dt.setStatus(status, p) != nil {
+		dt.mu.Unlock()
+		return
+	}
+	dt.Error = f.err
+	dt.emitLocked(Event{Type: EventError, FileId: f.Id, Err: f.err}, p)
+	dt.mu.Unlock()
+	dt.notifyManager()
+}
+
+func (dt *HttpDownloadTask) onProgress() {
+	dt.mu.Lock()
+	m := dt.manager
+	due := time.Since(dt.lastProgressEvent) >= progressEventInterval
+	if due {
+		dt.lastProgressEvent = time.Now()
+	}
+	dt.mu.Unlock()
+	if due {
+		dt.emit(Event{Type: EventProgress})
+	}
+	if m != nil {
+		m.onTaskProgress(dt)
+	}
+}
+
+// Subscribe returns a subscription to the events of the task.
+func (dt *HttpDownloadTask) Subscribe() *Subscription {
+	return dt.events.Subscribe()
+}
+
+// SubscribeFunc calls fn for every event of the task.
+func (dt *HttpDownloadTask) SubscribeFunc(fn func(Event)) *Subscription {
+	return dt.events.SubscribeFunc(fn)
+}
+
+func (dt *HttpDownloadTask) emit(e Event) {
+	p := dt.progress()
+	dt.mu.Lock()
+	defer dt.mu.Unlock()
+	dt.emitLocked(e, p)
+}
+
+// taskProgress is a snapshot of the sizes of the files of a task.
+type taskProgress struct {
+	downloaded, total int
+}
+
+// progress reads the sizes of the files of the task. It takes the lock of
+// every file, so dt.mu must not be held.
+func (dt *HttpDownloadTask) progress() taskProgress {
+	return taskProgress{downloaded: dt.GetDownloaded(), total: dt.GetTotal()}
+}
+
+// emitLocked fills in the task fields of e, with the sizes from p, and
+// publishes it to the subscribers of the task and of its manager. dt.mu
+// must be held.
+func (dt *HttpDownloadTask) emitLocked(e Event, p taskProgress) {
+	e.Time = time.Now()
+	e.TaskId = dt.Id
+	e.Status = dt.Status
+	e.Downloaded = p.downloaded
+	e.Total = p.total
+	dt.events.publish(e)
+	if dt.manager != nil {
+		dt.manager.events.publish(e)
+	}
+}
+
+// context returns the context the connections of the task are derived from.
+func (dt *HttpDownloadTask) context() context.Context {
+	dt.mu.Lock()
+	defer dt.mu.Unlock()
+	return dt.ctx
+}
+
+func (dt *HttpDownloadTask) setManager(m *Manager) {
+	dt.mu.Lock()
+	defer dt.mu.Unlock()
+	dt.manager = m
+	if m != nil {
+		dt.ctx = m.ctx
+		dt.limiter.SetParent(dt.share)
+		dt.share.SetParent(m.limiter)
+	}
+}
+
+func (dt *HttpDownloadTask) notifyManager() {
+	dt.mu.Lock()
+	m := dt.manager
+	dt.mu.Unlock()
+	if m != nil {
+		m.onTaskFinished(dt)
+	}
 }
@@ -0,0 +1,398 @@
+package downloads
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func testContent(size int) []byte {
+	b := make([]byte, size)
+	rand.New(rand.NewSource(int64(size))).Read(b)
+	return b
+}
+
+type testServer struct {
+	*httptest.Server
+	mu       sync.Mutex
+	requests []*http.Request
+}
+
+// newTestServer serves every entry of files under "/<name>" with range support.
+func newTestServer(t *testing.T, files map[string][]byte) *testServer {
+	t.Helper()
+	srv := &testServer{}
+	srv.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		srv.mu.Lock()
+		srv.requests = append(srv.requests, r)
+		srv.mu.Unlock()
+		name := strings.TrimPrefix(r.URL.Path, "/")
+		content, ok := files[name]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name))
+		http.ServeContent(w, r, name, time.Time{}, bytes.NewReader(content))
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// rangeRequests returns the Range headers of the GET requests received so far.
+func (s *testServer) rangeRequests() (ranges []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, r := range s.requests {
+		if r.Method == http.MethodGet {
+			ranges = append(ranges, r.Header.Get("Range"))
+		}
+	}
+	return ranges
+}
+
+func waitStatus(t *testing.T, task DownloadTask, status Status) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for task.GetStatus() != status {
+		if time.Now().After(deadline) {
+			t.Fatalf("task %s: expected status %s, got %s (%v)", task.GetName(), status, task.GetStatus(), task.GetError())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func assertFile(t *testing.T, path string, content []byte) {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, content) {
+		t.Errorf("%s: content mismatch, got %d bytes, expected %d", path, len(data), len(content))
+	}
+}
+
+func TestHttpDownloadTask(t *testing.T) {
+	files := map[string][]byte{"a.bin": testContent(10000), "b.bin": testContent(20000)}
+	srv := newTestServer(t, files)
+	dir := t.TempDir()
+
+	task, err := NewHttpDownloadTask(dir, srv.URL+"/a.bin", srv.URL+"/b.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if task.GetName() != "a.bin" || task.GetTotal() != 30000 {
+		t.Fatalf("unexpected task %s with total %d", task.GetName(), task.GetTotal())
+	}
+	if err := task.Start(); err != nil {
+		t.Fatal(err)
+	}
+	waitStatus(t, task, StatusCompleted)
+	if task.GetDownloaded() != 30000 {
+		t.Errorf("expected 30000 bytes downloaded, got %d", task.GetDownloaded())
+	}
+	for name, content := range files {
+		assertFile(t, filepath.Join(dir, name), content)
+	}
+}
+
+// TestStateWhileStarting reads the state of a task, as its manager does on
+// every progress save, while its files are started one after the other.
+func TestStateWhileStarting(t *testing.T) {
+	files := map[string][]byte{}
+	for i := range 300 {
+		files[fmt.Sprintf("f%03d.bin", i)] = testContent(100 + i)
+	}
+	srv := newTestServer(t, files)
+	var urls []string
+	for name := range files {
+		urls = append(urls, srv.URL+"/"+name)
+	}
+	task, err := NewHttpDownloadTask(t.TempDir(), urls...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		for {
+			select {
+			case <-done:
+				return
+			case <-time.After(100 * time.Microsecond):
+				task.state()
+			}
+		}
+	}()
+	completed := make(chan struct{})
+	task.SubscribeFunc(func(e Event) {
+		if e.Type == EventStatusChanged && e.Status == StatusCompleted {
+			close(completed)
+		}
+	})
+	if err := task.Start(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-completed:
+	case <-time.After(10 * time.Second):
+		t.Fatal("the task deadlocked")
+	}
+	close(done)
+	<-stopped
+}
+
+func waitDownloaded(t *testing.T, task DownloadTask, n int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for task.GetDownloaded() < n {
+		if time.Now().After(deadline) {
+			t.Fatalf("task %s: expected %d bytes downloaded, got %d", task.GetName(), n, task.GetDownloaded())
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestPauseResume(t *testing.T) {
+	content := testContent(20000)
+	srv := newSlowServer(t, content, 500, func(int) time.Duration { return 10 * time.Millisecond })
+	dir := t.TempDir()
+
+	task, err := NewHttpDownloadTask(dir, srv.URL+"/slow.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := task.Start(); err != nil {
+		t.Fatal(err)
+	}
+	waitDownloaded(t, task, 2000)
+	if err := task.Pause(); err != nil {
+		t.Fatal(err)
+	}
+	paused := task.GetDownloaded()
+	time.Sleep(50 * time.Millisecond)
+	if task.GetStatus() != StatusPaused || task.GetDownloaded() != paused {
+		t.Fatalf("task kept downloading after pause: %s, %d -> %d", task.GetStatus(), paused, task.GetDownloaded())
+	}
+	if err := task.Pause(); !errors.Is(err, ErrInvalidTransition) {
+		t.Errorf("expected invalid transition pausing twice, got %v", err)
+	}
+
+	if err := task.Start(); err != nil {
+		t.Fatal(err)
+	}
+	waitStatus(t, task, StatusCompleted)
+	assertFile(t, filepath.Join(dir, "slow.bin"), content)
+	ranges := srv.rangeRequests()
+	if len(ranges) != 2 || ranges[1] != fmt.Sprintf("bytes=%d-", paused) {
+		t.Errorf("expected resume from %d, got %q", paused, ranges)
+	}
+
+	var transitionErr *TransitionError
+	if err := task.Start(); !errors.As(err, &transitionErr) || transitionErr.From != StatusCompleted {
+		t.Errorf("expected TransitionError starting a completed task, got %v", err)
+	}
+}
+
+func TestStopRequeues(t *testing.T) {
+	content := testContent(20000)
+	srv := newSlowServer(t, content, 500, func(int) time.Duration { return 10 * time.Millisecond })
+	dir := t.TempDir()
+
+	task, err := NewHttpDownloadTask(dir, srv.URL+"/slow.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := task.Start(); err != nil {
+		t.Fatal(err)
+	}
+	waitDownloaded(t, task, 1000)
+	if err := task.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	if task.GetStatus() != StatusQueued || task.GetDownloaded() != 0 {
+		t.Fatalf("expected a queued task without progress, got %s with %d bytes", task.GetStatus(), task.GetDownloaded())
+	}
+	if err := task.Stop(); !errors.Is(err, ErrInvalidTransition) {
+		t.Errorf("expected invalid transition stopping a queued task, got %v", err)
+	}
+}
+
+func TestDeleteWithData(t *testing.T) {
+	content := testContent(20000)
+	srv := newSlowServer(t, content, 500, func(int) time.Duration { return 10 * time.Millisecond })
+	dir := t.TempDir()
+	m := NewManager(dir, 1)
+
+	kept, err := m.Add(srv.URL + "/slow.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitStatus(t, kept, StatusCompleted)
+	if err := kept.Delete(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.Get(kept.GetId()); err != ErrTaskNotFound {
+		t.Errorf("deleted task is still in the manager: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "slow.bin")); err != nil {
+		t.Errorf("Delete must keep the data: %v", err)
+	}
+
+	removed, err := m.Add(srv.URL + "/slow.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitDownloaded(t, removed, 1000)
+	if err := m.RemoveWithData(removed.GetId()); err != nil {
+		t.Fatal(err)
+	}
+	// The kept data is not overwritten by the second download.
+	if _, err := os.Stat(filepath.Join(dir, "slow (1).bin"+partSuffix)); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("DeleteWithData must remove the data: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "slow.bin")); err != nil {
+		t.Errorf("DeleteWithData must keep the data of the other task: %v", err)
+	}
+	if len(m.List()) != 0 {
+		t.Errorf("expected no tasks left, got %d", len(m.List()))
+	}
+	if err := removed.Start(); !errors.Is(err, ErrInvalidTransition) {
+		t.Errorf("expected invalid transition starting a deleted task, got %v", err)
+	}
+}
+
+func TestPauseInterruptsBlockedReads(t *testing.T) {
+	content := testContent(20000)
+	// The server stalls for a long time after the first chunk.
+	srv := newSlowServer(t, content, 1000, func(int) time.Duration { return time.Minute })
+	limited := newTestServer(t, map[string][]byte{"limited.bin": content})
+	dir := t.TempDir()
+
+	stalled, err := NewHttpDownloadTask(dir, srv.URL+"/slow.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The limiter lets one 1 KiB read through per second.
+	waiting, err := NewHttpDownloadTask(dir, limited.URL+"/limited.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	waiting.Files[0].SetRateLimit(1024)
+	for _, task := range []*HttpDownloadTask{stalled, waiting} {
+		if err := task.Start(); err != nil {
+			t.Fatal(err)
+		}
+		waitDownloaded(t, task, 1000)
+		start := time.Now()
+		if err := task.Pause(); err != nil {
+			t.Fatal(err)
+		}
+		if elapsed := time.Since(start); elapsed > 200*time.Millisecond {
+			t.Errorf("%s: pause took %s", task.GetName(), elapsed)
+		}
+	}
+}
+
+// newStreamServer serves content as "/stream.bin" without a Content-Length,
+// in chunks of 1000 bytes. It drops the connection after truncate bytes
+// when truncate is positive.
+func newStreamServer(t *testing.T, content []byte, truncate int) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Disposition", `attachment; filename="stream.bin"`)
+		if r.Method == http.MethodHead {
+			return
+		}
+		for pos := 0; pos < len(content); pos += 1000 {
+			if truncate > 0 && pos >= truncate {
+				panic(http.ErrAbortHandler)
+			}
+			w.Write(content[pos:min(pos+1000, len(content))])
+			w.(http.Flusher).Flush()
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestUnknownLength(t *testing.T) {
+	content := testContent(25500)
+	srv := newStreamServer(t, content, 0)
+	dir := t.TempDir()
+
+	task, err := NewHttpDownloadTask(dir, srv.URL+"/stream.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	task.SetSegmentCount(4)
+	if task.GetTotal() != UnknownTotal {
+		t.Errorf("expected an unknown total, got %d", task.GetTotal())
+	}
+	if err := task.Start(); err != nil {
+		t.Fatal(err)
+	}
+	waitStatus(t, task, StatusCompleted)
+	assertFile(t, filepath.Join(dir, "stream.bin"), content)
+	if task.GetTotal() != len(content) {
+		t.Errorf("expected the total to be known after EOF, got %d", task.GetTotal())
+	}
+
+	truncated, err := NewHttpDownloadTask(t.TempDir(), newStreamServer(t, content, 10000).URL+"/stream.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	truncated.SetRetryPolicy(&testRetryPolicy)
+	if err := truncated.Start(); err != nil {
+		t.Fatal(err)
+	}
+	waitStatus(t, truncated, StatusFailed)
+	if truncated.GetTotal() != UnknownTotal {
+		t.Errorf("expected a truncated stream to keep an unknown total, got %d", truncated.GetTotal())
+	}
+}
+
+func TestUnknownLengthRetryShorter(t *testing.T) {
+	first, second := testContent(15000), testContent(5000)
+	var downloads atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Disposition", `attachment; filename="export.csv"`)
+		if r.Method == http.MethodHead || r.Header.Get("Range") != "" {
+			// Neither the size nor range support is announced.
+			return
+		}
+		if downloads.Add(1) > 1 {
+			// The export is generated again, shorter this time.
+			w.Write(second)
+			return
+		}
+		w.Write(first)
+		w.(http.Flusher).Flush()
+		panic(http.ErrAbortHandler)
+	}))
+	t.Cleanup(srv.Close)
+	dir := t.TempDir()
+
+	task, err := NewHttpDownloadTask(dir, srv.URL+"/export.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	task.SetRetryPolicy(&testRetryPolicy)
+	if err := task.Start(); err != nil {
+		t.Fatal(err)
+	}
+	waitStatus(t, task, StatusCompleted)
+	assertFile(t, filepath.Join(dir, "export.csv"), second)
+}
@@ -0,0 +1,159 @@
+package downloads
+
+import (
+	"context"
+	"io"
+	"sync/atomic"
+
+	"golang.org/x/time/rate"
+)
+
+// SpeedLimiter limits the bytes per second passing through it. Limiters
+// are nested: the bytes waited for on a limiter are charged to its parent
+// as well, so a manager limit caps its tasks and a task limit its files.
+type SpeedLimiter struct {
+	*rate.Limiter
+	parent atomic.Pointer[SpeedLimiter]
+}
+
+func NewSpeedLimiter(bytesPerSec int) *SpeedLimiter {
+	var rateLimit rate.Limit
+	if bytesPerSec == 0 {
+		rateLimit = rate.Inf
+	} else {
+		rateLimit = rate.Limit(bytesPerSec)
+	}
+	return &SpeedLimiter{Limiter: rate.NewLimiter(rateLimit, bytesPerSec)}
+}
+
+// newChildSpeedLimiter returns a limiter whose bytes are also charged to parent.
+func newChildSpeedLimiter(parent *SpeedLimiter, bytesPerSec int) *SpeedLimiter {
+	l := NewSpeedLimiter(bytesPerSec)
+	l.SetParent(parent)
+	return l
+}
+
+func (l *SpeedLimiter) SetLimit(bytesPerSec int) {
+	if bytesPerSec == 0 {
+		l.Limiter.SetLimit(rate.Inf)
+	} else {
+		l.Limiter.SetLimit(rate.Limit(bytesPerSec))
+	}
+	l.Limiter.SetBurst(bytesPerSec)
+}
+
+// GetLimit returns the limit in bytes per second, zero when unlimited.
+func (l *SpeedLimiter) GetLimit() int {
+	if l.Limit() == rate.Inf {
+		return 0
+	}
+	return int(l.Limit())
+}
+
+// SetParent sets the limiter the bytes of l are charged to as well.
+func (l *SpeedLimiter) SetParent(parent *SpeedLimiter) {
+	l.parent.Store(parent)
+}
+
+// WaitN blocks until n bytes may pass l and all of its parents.
+func (l *SpeedLimiter) WaitN(ctx context.Context, n int) error {
+	for ; l != nil; l = l.parent.Load() {
+		if err := l.waitN(ctx, n); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// waitN waits for n bytes on l alone. Waits larger than the burst, which is
+// a second worth of bytes, are split so slow limits don't reject reads.
+func (l *SpeedLimiter) waitN(ctx context.Context, n int) error {
+	for n > 0 {
+		chunk := n
+		if l.Limit() != rate.Inf {
+			chunk = min(n, max(l.Burst(), 1))
+		}
+		if err := l.Limiter.WaitN(ctx, chunk); err != nil {
+			// The limit may have been lowered since the burst was read.
+			if ctx.Err() == nil && chunk > l.Burst() && l.Limit() != rate.Inf {
+				continue
+			}
+			return err
+		}
+		n -= chunk
+	}
+	return nil
+}
+
+// shareBandwidth splits limit between consumers in proportion to their
+// weights. A consumer capped below its share gets its cap and what it
+// leaves is split between the others.
+func shareBandwidth(limit int, weights, caps []int) []int {
+	shares := make([]int, len(weights))
+	if limit <= 0 {
+		return shares
+	}
+	fixed := make([]bool, len(weights))
+	remaining := limit
+	for {
+		total := 0
+		for i, w := range weights {
+			if !fixed[i] {
+				total += w
+			}
+		}
+		if total == 0 {
+			return shares
+		}
+		capped := false
+		for i, w := range weights {
+			if !fixed[i] && caps[i] > 0 && caps[i]*total <= remaining*w {
+				shares[i] = caps[i]
+				fixed[i] = true
+				remaining -= caps[i]
+				capped = true
+			}
+		}
+		if !capped {
+			for i, w := range weights {
+				if !fixed[i] {
+					shares[i] = max(remaining*w/total, 1)
+				}
+			}
+			return shares
+		}
+	}
+}
+
+type RateLimitedIO struct {
+	ctx     context.Context
+	reader  io.Reader
+	limiter *SpeedLimiter
+}
+
+func NewRateLimitedIO(reader io.Reader, bytesPerSec int) (*RateLimitedIO, *SpeedLimiter) {
+	limiter := NewSpeedLimiter(bytesPerSec)
+	return &RateLimitedIO{
+		ctx:     context.Background(),
+		reader:  reader,
+		limiter: limiter,
+	}, limiter
+}
+
+// WithContext returns a copy of r which stops waiting for the limiter when ctx is done.
+func (r *RateLimitedIO) WithContext(ctx context.Context) *RateLimitedIO {
+	r2 := *r
+	r2.ctx = ctx
+	return &r2
+}
+
+func (r *RateLimitedIO) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	if err != nil {
+		return n, err
+	}
+
+	// Wait for permission to read n bytes
+	err = r.limiter.WaitN(r.ctx, n)
+	return n, err
+}
@@ -0,0 +1,161 @@
+package downloads
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestSpeedLimiterWaitOverBurst(t *testing.T) {
+	l := NewSpeedLimiter(200)
+	start := time.Now()
+	// The burst is 200 bytes: 300 bytes take another half second.
+	if err := l.WaitN(context.Background(), 300); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 400*time.Millisecond {
+		t.Errorf("waited only %s", elapsed)
+	}
+}
+
+func TestSpeedLimiterParent(t *testing.T) {
+	parent := NewSpeedLimiter(1000)
+	child := newChildSpeedLimiter(parent, 0)
+	if err := child.WaitN(context.Background(), 1000); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	if err := child.WaitN(context.Background(), 500); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 400*time.Millisecond {
+		t.Errorf("the parent limit was not applied, waited %s", elapsed)
+	}
+
+	parent.SetLimit(0)
+	start = time.Now()
+	if err := child.WaitN(context.Background(), 100000); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Errorf("unlimited limiters must not wait, waited %s", elapsed)
+	}
+}
+
+func TestManagerRateLimit(t *testing.T) {
+	files := map[string][]byte{"a.bin": testContent(20000), "b.bin": testContent(20001)}
+	srv := newTestServer(t, files)
+	dir := t.TempDir()
+	m := NewManager(dir, 2)
+	m.SetRateLimit(20000)
+	if m.GetRateLimit() != 20000 {
+		t.Fatalf("unexpected rate limit %d", m.GetRateLimit())
+	}
+
+	start := time.Now()
+	var tasks []DownloadTask
+	for name := range files {
+		task, err := m.Add(fmt.Sprintf("%s/%s", srv.URL, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		tasks = append(tasks, task)
+	}
+	for _, task := range tasks {
+		waitStatus(t, task, StatusCompleted)
+	}
+	// 20000 bytes pass with the burst, the other 20001 take a second.
+	if elapsed := time.Since(start); elapsed < 800*time.Millisecond {
+		t.Errorf("downloaded 40001 bytes in %s over a 20000 B/s limit", elapsed)
+	}
+	for name, content := range files {
+		assertFile(t, filepath.Join(dir, name), content)
+	}
+}
+
+func TestTaskRateLimitAtRuntime(t *testing.T) {
+	content := testContent(20000)
+	srv := newTestServer(t, map[string][]byte{"a.bin": content})
+	dir := t.TempDir()
+
+	task, err := NewHttpDownloadTask(dir, srv.URL+"/a.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	task.SetRateLimit(2048)
+	if err := task.Start(); err != nil {
+		t.Fatal(err)
+	}
+	waitDownloaded(t, task, 2048)
+	time.Sleep(200 * time.Millisecond)
+	if downloaded := task.GetDownloaded(); downloaded > 4096 {
+		t.Fatalf("downloaded %d bytes over the task limit", downloaded)
+	}
+	task.SetRateLimit(0)
+	waitStatus(t, task, StatusCompleted)
+	assertFile(t, filepath.Join(dir, "a.bin"), content)
+}
+
+func TestShareBandwidth(t *testing.T) {
+	cases := []struct {
+		limit    int
+		weights  []int
+		caps     []int
+		expected []int
+	}{
+		{0, []int{1, 1}, []int{0, 0}, []int{0, 0}},
+		{40000, []int{3, 1}, []int{0, 0}, []int{30000, 10000}},
+		{40000, []int{1, 1, 2}, []int{0, 0, 0}, []int{10000, 10000, 20000}},
+		// The capped task leaves its unused share to the others.
+		{40000, []int{3, 1, 1}, []int{0, 0, 2000}, []int{28500, 9500, 2000}},
+		{40000, []int{1}, []int{50000}, []int{40000}},
+	}
+	for _, c := range cases {
+		shares := shareBandwidth(c.limit, c.weights, c.caps)
+		if !slices.Equal(shares, c.expected) {
+			t.Errorf("shareBandwidth(%d, %v, %v) = %v, expected %v", c.limit, c.weights, c.caps, shares, c.expected)
+		}
+	}
+}
+
+func TestWeightedSharing(t *testing.T) {
+	files := map[string][]byte{"heavy.bin": testContent(1000000), "light.bin": testContent(1000001)}
+	srv := newTestServer(t, files)
+	m := NewManager(t.TempDir(), 2)
+	m.SetRateLimit(40000)
+	t.Cleanup(func() { m.Close() })
+
+	heavy, err := m.Add(srv.URL + "/heavy.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	heavy.(*HttpDownloadTask).SetWeight(3)
+	light, err := m.Add(srv.URL + "/light.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Skip the bursts of the limiters before measuring.
+	time.Sleep(1500 * time.Millisecond)
+	heavyStart, lightStart := heavy.GetDownloaded(), light.GetDownloaded()
+	time.Sleep(time.Second)
+	heavyBytes, lightBytes := heavy.GetDownloaded()-heavyStart, light.GetDownloaded()-lightStart
+	if lightBytes == 0 || heavyBytes < 2*lightBytes || heavyBytes > 5*lightBytes {
+		t.Errorf("expected a 3:1 split, got %d and %d bytes", heavyBytes, lightBytes)
+	}
+
+	// The share of a paused task goes to the others.
+	if err := heavy.Pause(); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(time.Second)
+	for light.(*HttpDownloadTask).share.GetLimit() != 40000 {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the whole limit for the light task, got %d", light.(*HttpDownloadTask).share.GetLimit())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
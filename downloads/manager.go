@@ -0,0 +1,464 @@
+package downloads
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+var (
+	ErrTaskNotFound  = errors.New("download task not found")
+	ErrTaskExists    = errors.New("download task already added")
+	ErrManagerClosed = errors.New("download manager is closed")
+)
+
+// managedTask is implemented by tasks that report back to the Manager
+// when they stop being active.
+type managedTask interface {
+	setManager(m *Manager)
+}
+
+// weightedTask is implemented by tasks that get a share of the manager rate
+// limit in proportion to their weight.
+type weightedTask interface {
+	GetWeight() int
+	GetRateLimit() int
+	setShare(bytesPerSec int)
+}
+
+// progressSaveInterval is how often the progress of running tasks is written to the store.
+const progressSaveInterval = time.Second
+
+// Manager owns download tasks and keeps at most maxActive of them started,
+// promoting queued tasks in the order they were added.
+type Manager struct {
+	Path      string
+	mu        sync.Mutex
+	tasks     []DownloadTask
+	maxActive int
+	store     Store
+	saveMu    sync.Mutex
+	// saves tracks the background saves, Close waits for them. Once closed
+	// is set no more are started. savesMu guards closed and lastSave, the
+	// time of the last progress checkpoint.
+	saves    sync.WaitGroup
+	savesMu  sync.Mutex
+	closed   bool
+	lastSave time.Time
+	// segmentCount is applied to every task created by Add.
+	segmentCount int
+	// ctx is the parent of every task context, cancel closes all connections on Close.
+	ctx    context.Context
+	cancel context.CancelFunc
+	// events receives the events of every task in the manager.
+	events      eventHub
+	retryPolicy RetryPolicy
+	// hosts limits the connections of all tasks to hosts which throttle us.
+	hosts *hostThrottle
+	// limiter caps the total speed of all tasks, shareMu serializes the
+	// splits of its limit between the started tasks.
+	limiter *SpeedLimiter
+	shareMu sync.Mutex
+	// startMu serializes the passes of schedule, so that concurrent ones
+	// don't start more than maxActive tasks.
+	startMu sync.Mutex
+	// clock drives the schedule, stopSchedule stops it. scheduleMu
+	// serializes the rules it applies, paused is set by the rule in force.
+	clock        Clock
+	stopSchedule context.CancelFunc
+	scheduleMu   sync.Mutex
+	paused       bool
+	// client makes the requests of tasks without a client of their own.
+	client *httpClient
+	// collisionPolicy applies to the files of tasks added by Add.
+	collisionPolicy CollisionPolicy
+}
+
+func NewManager(path string, maxActive int) *Manager {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Manager{
+		Path:         path,
+		maxActive:    maxActive,
+		segmentCount: 1,
+		ctx:          ctx,
+		cancel:       cancel,
+		retryPolicy:  DefaultRetryPolicy,
+		hosts:        newHostThrottle(),
+		limiter:      NewSpeedLimiter(0),
+		clock:        systemClock{},
+	}
+}
+
+// Add creates an HTTP task for url in the manager download directory and queues it.
+func (m *Manager) Add(url string) (DownloadTask, error) {
+	if m.ctx.Err() != nil {
+		return nil, ErrManagerClosed
+	}
+	task, err := newHttpDownloadTask(m.ctx, m, nil, m.Path, []string{url})
+	if err != nil {
+		return nil, err
+	}
+	m.mu.Lock()
+	task.SetSegmentCount(m.segmentCount)
+	m.mu.Unlock()
+	return task, m.AddTask(task)
+}
+
+func (m *Manager) AddTask(task DownloadTask) error {
+	if err := m.add(task); err != nil {
+		return err
+	}
+	m.schedule()
+	m.goSave(func() { m.persist() })
+	return nil
+}
+
+func (m *Manager) add(task DownloadTask) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.ctx.Err() != nil {
+		return ErrManagerClosed
+	}
+	if m.indexOf(task.GetId()) >= 0 {
+		return ErrTaskExists
+	}
+	if t, ok := task.(*HttpDownloadTask); ok {
+		if err := t.reserveNames(m); err != nil {
+			return err
+		}
+	}
+	if t, ok := task.(managedTask); ok {
+		t.setManager(m)
+	}
+	m.tasks = append(m.tasks, task)
+	m.emit(task, EventTaskAdded)
+	return nil
+}
+
+func (m *Manager) Get(id uuid.UUID) (DownloadTask, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	i := m.indexOf(id)
+	if i < 0 {
+		return nil, ErrTaskNotFound
+	}
+	return m.tasks[i], nil
+}
+
+func (m *Manager) List() []DownloadTask {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	tasks := make([]DownloadTask, len(m.tasks))
+	copy(tasks, m.tasks)
+	return tasks
+}
+
+// Remove deletes a task and drops it from the manager, keeping its files.
+func (m *Manager) Remove(id uuid.UUID) error {
+	task, err := m.Get(id)
+	if err != nil {
+		return err
+	}
+	if err := task.Delete(); err != nil {
+		return err
+	}
+	m.forget(task)
+	return nil
+}
+
+// RemoveWithData deletes a task with its files and drops it from the manager.
+func (m *Manager) RemoveWithData(id uuid.UUID) error {
+	task, err := m.Get(id)
+	if err != nil {
+		return err
+	}
+	if err := task.DeleteWithData(); err != nil {
+		return err
+	}
+	m.forget(task)
+	return nil
+}
+
+// SetStore makes the manager save the state of its tasks to s.
+func (m *Manager) SetStore(s Store) {
+	m.saveMu.Lock()
+	defer m.saveMu.Unlock()
+	m.store = s
+}
+
+// Load restores the tasks saved in the store and queues the ones that were
+// running when the state was saved. Tasks already in the manager are kept.
+func (m *Manager) Load() error {
+	m.saveMu.Lock()
+	store := m.store
+	m.saveMu.Unlock()
+	if store == nil {
+		return errors.New("manager has no store")
+	}
+	states, err := store.Load()
+	if err != nil {
+		return err
+	}
+	m.mu.Lock()
+	for _, s := range states {
+		if s.Type != DownloadTaskTypeHTTP || m.indexOf(s.Id) >= 0 {
+			continue
+		}
+		task := restoreHttpDownloadTask(s)
+		task.setManager(m)
+		m.tasks = append(m.tasks, task)
+		m.emit(task, EventTaskAdded)
+	}
+	m.mu.Unlock()
+	m.schedule()
+	return nil
+}
+
+// Save writes the state of every task to the store.
+func (m *Manager) Save() error {
+	return m.persist()
+}
+
+// Close cancels every running connection, waits for the downloads to stop
+// and saves their state. Started tasks are saved as started, so Load queues
+// them again. The manager can't be used after Close.
+func (m *Manager) Close() error {
+	m.mu.Lock()
+	m.cancel()
+	tasks := make([]DownloadTask, len(m.tasks))
+	copy(tasks, m.tasks)
+	m.mu.Unlock()
+	for _, task := range tasks {
+		if t, ok := task.(*HttpDownloadTask); ok {
+			t.wait()
+		}
+	}
+	m.savesMu.Lock()
+	m.closed = true
+	m.savesMu.Unlock()
+	m.saves.Wait()
+	return m.persist()
+}
+
+func (m *Manager) GetMaxActive() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.maxActive
+}
+
+// SetMaxActive changes the number of tasks allowed to run at once.
+// Zero or less means no limit.
+func (m *Manager) SetMaxActive(n int) {
+	m.mu.Lock()
+	m.maxActive = n
+	m.mu.Unlock()
+	m.schedule()
+}
+
+// SetSegmentCount sets the number of connections per file for tasks created by Add.
+func (m *Manager) SetSegmentCount(n int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.segmentCount = max(n, 1)
+}
+
+// Subscribe returns a subscription to the events of every task in the manager.
+func (m *Manager) Subscribe() *Subscription {
+	return m.events.Subscribe()
+}
+
+// SubscribeFunc calls fn for the events of every task in the manager.
+func (m *Manager) SubscribeFunc(fn func(Event)) *Subscription {
+	return m.events.SubscribeFunc(fn)
+}
+
+func (m *Manager) emit(task DownloadTask, t EventType) {
+	m.events.publish(Event{
+		Type:       t,
+		Time:       time.Now(),
+		TaskId:     task.GetId(),
+		Status:     task.GetStatus(),
+		Downloaded: task.GetDownloaded(),
+		Total:      task.GetTotal(),
+	})
+}
+
+// GetRetryPolicy returns the retry policy of tasks without a policy of their own.
+func (m *Manager) GetRetryPolicy() RetryPolicy {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.retryPolicy
+}
+
+func (m *Manager) SetRetryPolicy(p RetryPolicy) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.retryPolicy = p
+}
+
+// SetRateLimit caps the total download speed of all tasks in bytes per
+// second, on top of the limits of every task. The limit is split between
+// the started tasks in proportion to their weights. Zero removes the cap.
+func (m *Manager) SetRateLimit(bytesPerSec int) {
+	m.limiter.SetLimit(bytesPerSec)
+	m.rebalance()
+}
+
+func (m *Manager) GetRateLimit() int {
+	return m.limiter.GetLimit()
+}
+
+// rebalance splits the rate limit between the started tasks in proportion
+// to their weights. The other tasks are left unlimited until they start.
+func (m *Manager) rebalance() {
+	m.shareMu.Lock()
+	defer m.shareMu.Unlock()
+	var tasks []weightedTask
+	var weights, caps []int
+	m.mu.Lock()
+	for _, task := range m.tasks {
+		t, ok := task.(weightedTask)
+		if !ok {
+			continue
+		}
+		if task.GetStatus() != StatusStarted {
+			t.setShare(0)
+			continue
+		}
+		tasks = append(tasks, t)
+		weights = append(weights, t.GetWeight())
+		caps = append(caps, t.GetRateLimit())
+	}
+	m.mu.Unlock()
+	for i, share := range shareBandwidth(m.limiter.GetLimit(), weights, caps) {
+		tasks[i].setShare(share)
+	}
+}
+
+// rebalanceLater rebalances the rate limit in the background. It's safe to
+// call with task locks held.
+func (m *Manager) rebalanceLater() {
+	if m.limiter.GetLimit() > 0 {
+		go m.rebalance()
+	}
+}
+
+func (m *Manager) indexOf(id uuid.UUID) int {
+	for i, task := range m.tasks {
+		if task.GetId() == id {
+			return i
+		}
+	}
+	return -1
+}
+
+// schedule starts queued tasks while there are free slots. m.mu must not be
+// held: starting a task waits for the Stop, Pause or Delete in progress on
+// it, which may need m.mu to finish.
+func (m *Manager) schedule() {
+	m.startMu.Lock()
+	defer m.startMu.Unlock()
+	m.mu.Lock()
+	if m.ctx.Err() != nil || m.paused {
+		m.mu.Unlock()
+		return
+	}
+	maxActive := m.maxActive
+	tasks := make([]DownloadTask, len(m.tasks))
+	copy(tasks, m.tasks)
+	m.mu.Unlock()
+	active := 0
+	for _, task := range tasks {
+		if task.GetStatus() == StatusStarted {
+			active++
+		}
+	}
+	for _, task := range tasks {
+		if maxActive > 0 && active >= maxActive {
+			return
+		}
+		if task.GetStatus() != StatusQueued {
+			continue
+		}
+		if err := task.Start(); err != nil {
+			continue
+		}
+		if task.GetStatus() == StatusStarted {
+			active++
+		}
+	}
+}
+
+// forget drops a deleted task from the manager and gives its slot to the next queued task.
+func (m *Manager) forget(task DownloadTask) {
+	m.mu.Lock()
+	i := m.indexOf(task.GetId())
+	if i < 0 {
+		m.mu.Unlock()
+		return
+	}
+	m.tasks = append(m.tasks[:i], m.tasks[i+1:]...)
+	m.mu.Unlock()
+	if t, ok := task.(managedTask); ok {
+		t.setManager(nil)
+	}
+	m.emit(task, EventTaskRemoved)
+	m.onTaskFinished(task)
+}
+
+func (m *Manager) persist() error {
+	m.saveMu.Lock()
+	defer m.saveMu.Unlock()
+	if m.store == nil {
+		return nil
+	}
+	m.mu.Lock()
+	var states []TaskState
+	for _, task := range m.tasks {
+		if t, ok := task.(persistentTask); ok {
+			states = append(states, t.state())
+		}
+	}
+	m.mu.Unlock()
+	return m.store.Save(states)
+}
+
+// goSave runs fn in the background unless the manager is closed, Close
+// waits for it.
+func (m *Manager) goSave(fn func()) {
+	m.savesMu.Lock()
+	defer m.savesMu.Unlock()
+	if m.closed {
+		return
+	}
+	m.saves.Add(1)
+	go func() {
+		defer m.saves.Done()
+		fn()
+	}()
+}
+
+// onTaskProgress checkpoints the progress of the tasks every
+// progressSaveInterval. The save runs in the background, so downloads never
+// wait for the store.
+func (m *Manager) onTaskProgress(task DownloadTask) {
+	m.savesMu.Lock()
+	due := !m.closed && time.Since(m.lastSave) >= progressSaveInterval
+	if due {
+		m.lastSave = time.Now()
+	}
+	m.savesMu.Unlock()
+	if due {
+		m.goSave(func() { m.persist() })
+	}
+}
+
+func (m *Manager) onTaskFinished(task DownloadTask) {
+	m.goSave(func() {
+		m.schedule()
+		m.persist()
+	})
+}
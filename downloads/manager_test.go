@@ -0,0 +1,125 @@
+package downloads
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestManagerQueue(t *testing.T) {
+	files := map[string][]byte{}
+	for i := 0; i < 4; i++ {
+		files[fmt.Sprintf("%d.bin", i)] = testContent(5000 + i)
+	}
+	srv := newTestServer(t, files)
+	dir := t.TempDir()
+	m := NewManager(dir, 1)
+
+	var tasks []DownloadTask
+	for i := 0; i < 4; i++ {
+		task, err := m.Add(fmt.Sprintf("%s/%d.bin", srv.URL, i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		tasks = append(tasks, task)
+	}
+	if len(m.List()) != 4 {
+		t.Fatalf("expected 4 tasks, got %d", len(m.List()))
+	}
+	for _, task := range tasks {
+		waitStatus(t, task, StatusCompleted)
+	}
+	for name, content := range files {
+		assertFile(t, filepath.Join(dir, name), content)
+	}
+
+	got, err := m.Get(tasks[2].GetId())
+	if err != nil || got != tasks[2] {
+		t.Fatalf("Get returned %v, %v", got, err)
+	}
+	if err := m.Remove(tasks[2].GetId()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.Get(tasks[2].GetId()); err != ErrTaskNotFound {
+		t.Errorf("expected ErrTaskNotFound, got %v", err)
+	}
+}
+
+func TestManagerClose(t *testing.T) {
+	content := testContent(20000)
+	srv := newSlowServer(t, content, 1000, func(int) time.Duration { return 20 * time.Millisecond })
+	dir := t.TempDir()
+	m := NewManager(dir, 1)
+	m.SetStore(NewFileStore(dir))
+
+	task, err := m.Add(srv.URL + "/slow.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitDownloaded(t, task, 3000)
+	if err := m.Close(); err != nil {
+		t.Fatal(err)
+	}
+	downloaded := task.GetDownloaded()
+	if _, err := m.Add(srv.URL + "/slow.bin"); err != ErrManagerClosed {
+		t.Errorf("expected ErrManagerClosed, got %v", err)
+	}
+
+	m = NewManager(dir, 1)
+	m.SetStore(NewFileStore(dir))
+	if err := m.Load(); err != nil {
+		t.Fatal(err)
+	}
+	restored, err := m.Get(task.GetId())
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitStatus(t, restored, StatusCompleted)
+	assertFile(t, filepath.Join(dir, "slow.bin"), content)
+	ranges := srv.rangeRequests()
+	if last := ranges[len(ranges)-1]; last != fmt.Sprintf("bytes=%d-", downloaded) {
+		t.Errorf("expected resume from %d, got %q", downloaded, ranges)
+	}
+}
+
+// TestStopWhileScheduling stops a task of many connections while the
+// manager schedules its tasks.
+func TestStopWhileScheduling(t *testing.T) {
+	content := testContent(100000)
+	srv := newSlowServer(t, content, 1000, func(int) time.Duration { return 10 * time.Millisecond })
+	m := NewManager(t.TempDir(), 1)
+	t.Cleanup(func() { m.Close() })
+	m.SetSegmentCount(8)
+	task, err := m.Add(srv.URL + "/slow.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitDownloaded(t, task, 5000)
+
+	done := make(chan struct{})
+	scheduling := make(chan struct{})
+	go func() {
+		defer close(scheduling)
+		for {
+			select {
+			case <-done:
+				return
+			default:
+				m.SetMaxActive(0)
+			}
+		}
+	}()
+	stopped := make(chan error, 1)
+	go func() { stopped <- task.Stop() }()
+	select {
+	case err := <-stopped:
+		if err != nil {
+			t.Error(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Stop deadlocked")
+	}
+	close(done)
+	<-scheduling
+}
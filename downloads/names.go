@@ -0,0 +1,304 @@
+package downloads
+
+import (
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+// CollisionPolicy decides what happens when a new file would be saved
+// under the name of an existing file, or of the file of another task.
+type CollisionPolicy string
+
+const (
+	// CollisionRename saves the file as "name (1).ext", or the first of
+	// "name (2).ext", "name (3).ext"... which is free.
+	CollisionRename CollisionPolicy = "rename"
+	// CollisionOverwrite replaces the existing file.
+	CollisionOverwrite CollisionPolicy = "overwrite"
+	// CollisionSkip keeps the existing file and completes the new one
+	// without downloading it.
+	CollisionSkip CollisionPolicy = "skip"
+	// CollisionFail refuses to create the task with ErrFileExists.
+	CollisionFail CollisionPolicy = "fail"
+)
+
+var ErrFileExists = errors.New("file already exists")
+
+// defaultFileName is the name of files whose URL doesn't end with one.
+const defaultFileName = "download"
+
+// maxFileNameLength is the longest name, in bytes, most file systems
+// accept, less room for the staging file suffix.
+const maxFileNameLength = 255 - len(partSuffix)
+
+// responseFileName returns the name to save the file of resp as: the
+// filename* or filename parameter of its Content-Disposition, or else the
+// last element of the URL it was finally fetched from, with an extension
+// guessed from its Content-Type when it has none.
+func responseFileName(resp *http.Response) string {
+	if name := sanitizeFileName(dispositionFileName(resp.Header.Get("Content-Disposition"))); name != "" {
+		return name
+	}
+	name := defaultFileName
+	if resp.Request != nil {
+		if base := sanitizeFileName(path.Base(resp.Request.URL.Path)); base != "" {
+			name = base
+		}
+	}
+	if path.Ext(name) == "" {
+		name += extensionByType(resp.Header.Get("Content-Type"))
+	}
+	return name
+}
+
+// looseFileNameRe finds the filename parameter of headers mime can't parse,
+// such as unquoted names with spaces.
+var looseFileNameRe = regexp.MustCompile(`(?i)(?:^|;)\s*filename\s*=\s*(?:"([^"]*)"|([^;]*))`)
+
+// dispositionFileName returns the file name of a Content-Disposition
+// header. The RFC 5987 filename* parameter, which may hold any UTF-8 name,
+// takes precedence over filename.
+func dispositionFileName(header string) string {
+	if header == "" {
+		return ""
+	}
+	// mime decodes filename* into filename, preferring it.
+	if _, params, err := mime.ParseMediaType(header); err == nil {
+		return params["filename"]
+	}
+	if match := looseFileNameRe.FindStringSubmatch(header); match != nil {
+		return strings.TrimSpace(match[1] + match[2])
+	}
+	return ""
+}
+
+// preferredExtensions overrides the first extension mime knows for common
+// types, which is not always the usual one.
+var preferredExtensions = map[string]string{
+	"text/plain":         ".txt",
+	"text/html":          ".html",
+	"image/jpeg":         ".jpg",
+	"application/gzip":   ".gz",
+	"application/x-gzip": ".gz",
+	"application/x-tar":  ".tar",
+	"application/zip":    ".zip",
+}
+
+// extensionByType returns the usual extension of a Content-Type, empty for
+// generic or unknown types.
+func extensionByType(contentType string) string {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil || mediaType == "application/octet-stream" {
+		return ""
+	}
+	if ext, ok := preferredExtensions[mediaType]; ok {
+		return ext
+	}
+	if exts, err := mime.ExtensionsByType(mediaType); err == nil && len(exts) > 0 {
+		return exts[0]
+	}
+	return ""
+}
+
+// reservedFileNames can't be used as file names on Windows, whatever their
+// extension.
+var reservedFileNames = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true,
+	"COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true, "COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true, "LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+}
+
+// sanitizeFileName turns a name chosen by a server into one that is safe
+// to create in the download directory on any platform: directories are
+// dropped, control and reserved characters replaced, leading and trailing
+// dots and spaces trimmed and long names shortened. It returns an empty
+// string when nothing is left.
+func sanitizeFileName(name string) string {
+	name = name[strings.LastIndexAny(name, `/\`)+1:]
+	name = strings.ToValidUTF8(name, "_")
+	name = strings.Map(func(r rune) rune {
+		if r < 0x20 || r == 0x7f {
+			return -1
+		}
+		if strings.ContainsRune(`<>:"|?*`, r) {
+			return '_'
+		}
+		return r
+	}, name)
+	name = strings.Trim(name, " .")
+	if name == "" {
+		return ""
+	}
+	if stem, _, _ := strings.Cut(name, "."); reservedFileNames[strings.ToUpper(stem)] {
+		name = "_" + name
+	}
+	if len(name) > maxFileNameLength {
+		ext := path.Ext(name)
+		if len(ext) > maxFileNameLength/2 {
+			ext = ""
+		}
+		stem := name[:maxFileNameLength-len(ext)]
+		for !utf8.ValidString(stem) {
+			stem = stem[:len(stem)-1]
+		}
+		name = stem + ext
+	}
+	return name
+}
+
+// splitExt splits name into its stem and extension, keeping the compressed
+// tarball extensions such as ".tar.gz" whole.
+func splitExt(name string) (string, string) {
+	ext := path.Ext(name)
+	stem := strings.TrimSuffix(name, ext)
+	if inner := path.Ext(stem); strings.EqualFold(inner, ".tar") {
+		return strings.TrimSuffix(stem, inner), inner + ext
+	}
+	return stem, ext
+}
+
+// resolveCollision applies policy when the file would be saved under the
+// name of an existing file or of another file of the task or its manager.
+// A name is taken too while its staging file is on disk, as another
+// download may still be writing it. inUse reports the names of the other
+// files of the task and its manager.
+func (f *HttpDownloadFile) resolveCollision(policy CollisionPolicy, inUse func(dir, name string) bool) error {
+	taken := func(name string) bool {
+		for _, n := range []string{name, name + partSuffix} {
+			if _, err := os.Lstat(filepath.Join(f.Path, n)); err == nil {
+				return true
+			}
+		}
+		return inUse(f.Path, name)
+	}
+	if !taken(f.Name) {
+		return nil
+	}
+	switch policy {
+	case CollisionOverwrite:
+	case CollisionSkip:
+		f.skipped = true
+		f.status = StatusCompleted
+		f.Downloaded, f.Total = 0, 0
+		if info, err := os.Stat(filepath.Join(f.Path, f.Name)); err == nil {
+			f.Downloaded, f.Total = int(info.Size()), int(info.Size())
+		}
+	case CollisionFail:
+		return fmt.Errorf("%w: %s", ErrFileExists, filepath.Join(f.Path, f.Name))
+	default:
+		stem, ext := splitExt(f.Name)
+		for i := 1; ; i++ {
+			if name := fmt.Sprintf("%s (%d)%s", stem, i, ext); !taken(name) {
+				f.Name = name
+				return nil
+			}
+		}
+	}
+	return nil
+}
+
+// nameTaken reports whether another file of the task or of its manager is
+// saved as name in dir.
+func (dt *HttpDownloadTask) nameTaken(dir, name string) bool {
+	if dt.fileNamed(dir, name, nil) {
+		return true
+	}
+	dt.mu.Lock()
+	m := dt.manager
+	dt.mu.Unlock()
+	if m == nil {
+		return false
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.nameTaken(dir, name)
+}
+
+// fileNamed reports whether a file of the task other than except is saved
+// as name in dir.
+func (dt *HttpDownloadTask) fileNamed(dir, name string, except *HttpDownloadFile) bool {
+	for _, f := range dt.Files {
+		if f != except && f.Path == dir && f.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// nameTaken reports whether a file of a task of the manager is saved as name
+// in dir. m.mu must be held.
+func (m *Manager) nameTaken(dir, name string) bool {
+	for _, task := range m.tasks {
+		for _, f := range task.GetFiles() {
+			if f.GetPath() == dir && f.GetName() == name {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// reserveNames resolves the collisions of the files of a task again as it
+// is added to m, so no other task of m can take their names meanwhile. The
+// names picked when the task was created may have been taken since by a
+// task added concurrently, and tasks created without a manager were never
+// checked against it. Files which have started are left alone. m.mu must
+// be held.
+func (dt *HttpDownloadTask) reserveNames(m *Manager) error {
+	policy := m.collisionPolicy
+	if policy == "" {
+		policy = CollisionRename
+	}
+	for _, f := range dt.Files {
+		f.mu.Lock()
+		var err error
+		if f.status == StatusQueued && f.Downloaded == 0 && !f.skipped {
+			err = f.resolveCollision(policy, func(dir, name string) bool {
+				return dt.fileNamed(dir, name, f) || m.nameTaken(dir, name)
+			})
+		}
+		f.mu.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+	dt.Name = dt.Files[0].Name
+	return nil
+}
+
+// collisionPolicy returns the collision policy of the manager of the task.
+func (dt *HttpDownloadTask) collisionPolicy() CollisionPolicy {
+	dt.mu.Lock()
+	m := dt.manager
+	dt.mu.Unlock()
+	if m == nil {
+		return CollisionRename
+	}
+	return m.GetCollisionPolicy()
+}
+
+// SetCollisionPolicy sets what happens when a task added to the manager
+// would save a file under the name of an existing one. The default is
+// CollisionRename.
+func (m *Manager) SetCollisionPolicy(p CollisionPolicy) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.collisionPolicy = p
+}
+
+func (m *Manager) GetCollisionPolicy() CollisionPolicy {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.collisionPolicy == "" {
+		return CollisionRename
+	}
+	return m.collisionPolicy
+}
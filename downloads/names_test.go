@@ -0,0 +1,182 @@
+package downloads
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestResponseFileName(t *testing.T) {
+	for _, c := range []struct {
+		url, disposition, contentType string
+		expected                      string
+	}{
+		{"http://h/dl/report.pdf", "", "application/pdf", "report.pdf"},
+		{"http://h/get", `attachment; filename="plain.txt"`, "", "plain.txt"},
+		{"http://h/get", `attachment; filename="fallback.txt"; filename*=UTF-8''r%C3%A9sum%C3%A9.txt`, "", "résumé.txt"},
+		{"http://h/get", `attachment; filename=my report.pdf`, "", "my report.pdf"},
+		{"http://h/get", `attachment; filename="../../etc/passwd"`, "", "passwd"},
+		{"http://h/get", `attachment; filename=".."`, "", "get"},
+		{"http://h/export?id=1", "", "application/json; charset=utf-8", "export.json"},
+		{"http://h/archive", "", "application/gzip", "archive.gz"},
+		{"http://h/blob", "", "application/octet-stream", "blob"},
+		{"http://h/", "", "text/html", "download.html"},
+	} {
+		u, _ := url.Parse(c.url)
+		resp := &http.Response{Header: http.Header{}, Request: &http.Request{URL: u}}
+		if c.disposition != "" {
+			resp.Header.Set("Content-Disposition", c.disposition)
+		}
+		if c.contentType != "" {
+			resp.Header.Set("Content-Type", c.contentType)
+		}
+		if name := responseFileName(resp); name != c.expected {
+			t.Errorf("%s %q: expected %q, got %q", c.url, c.disposition, c.expected, name)
+		}
+	}
+}
+
+func TestSanitizeFileName(t *testing.T) {
+	for _, c := range []struct{ name, expected string }{
+		{"report.pdf", "report.pdf"},
+		{`C:\Windows\system.ini`, "system.ini"},
+		{"a<b>c:d|e?f*g\".txt", "a_b_c_d_e_f_g_.txt"},
+		{"bell\a\x00.txt", "bell.txt"},
+		{"  .hidden. ", "hidden"},
+		{"con.txt", "_con.txt"},
+		{"LPT1", "_LPT1"},
+		{"console.txt", "console.txt"},
+		{"...", ""},
+		{"bad\xffutf8", "bad_utf8"},
+		{strings.Repeat("é", 200) + ".tar", strings.Repeat("é", 123) + ".tar"},
+	} {
+		if name := sanitizeFileName(c.name); name != c.expected {
+			t.Errorf("%q: expected %q, got %q", c.name, c.expected, name)
+		}
+	}
+}
+
+func TestCollisionPolicies(t *testing.T) {
+	content := testContent(5000)
+	srv := newTestServer(t, map[string][]byte{"data.tar.gz": content})
+	existing := []byte("existing")
+
+	for _, c := range []struct {
+		policy   CollisionPolicy
+		name     string
+		expected []byte
+		err      error
+	}{
+		{"", "data (1).tar.gz", content, nil},
+		{CollisionOverwrite, "data.tar.gz", content, nil},
+		{CollisionSkip, "data.tar.gz", existing, nil},
+		{CollisionFail, "", nil, ErrFileExists},
+	} {
+		dir := t.TempDir()
+		if err := os.WriteFile(filepath.Join(dir, "data.tar.gz"), existing, 0666); err != nil {
+			t.Fatal(err)
+		}
+		m := NewManager(dir, 1)
+		t.Cleanup(func() { m.Close() })
+		m.SetCollisionPolicy(c.policy)
+		task, err := m.Add(srv.URL + "/data.tar.gz")
+		if !errors.Is(err, c.err) {
+			t.Fatalf("%s: expected error %v, got %v", c.policy, c.err, err)
+		}
+		if err != nil {
+			continue
+		}
+		if name := task.GetFiles()[0].GetName(); name != c.name {
+			t.Errorf("%s: expected the file to be saved as %q, got %q", c.policy, c.name, name)
+		}
+		waitStatus(t, task, StatusCompleted)
+		assertFile(t, filepath.Join(dir, c.name), c.expected)
+		if c.policy == CollisionSkip {
+			if err := m.RemoveWithData(task.GetId()); err != nil {
+				t.Fatal(err)
+			}
+			assertFile(t, filepath.Join(dir, c.name), existing)
+		}
+	}
+
+	// Files of other tasks are taken too, even before they are on disk.
+	dir := t.TempDir()
+	m := NewManager(dir, 1)
+	t.Cleanup(func() { m.Close() })
+	var names []string
+	for range 3 {
+		task, err := m.Add(srv.URL + "/data.tar.gz")
+		if err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, task.GetFiles()[0].GetName())
+	}
+	if strings.Join(names, ",") != "data.tar.gz,data (1).tar.gz,data (2).tar.gz" {
+		t.Errorf("unexpected names %q", names)
+	}
+
+	// So are the names of files another download is still writing.
+	dir = t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "data.tar.gz"+partSuffix), existing, 0666); err != nil {
+		t.Fatal(err)
+	}
+	staged := NewManager(dir, 1)
+	t.Cleanup(func() { staged.Close() })
+	task, err := staged.Add(srv.URL + "/data.tar.gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name := task.GetFiles()[0].GetName(); name != "data (1).tar.gz" {
+		t.Errorf("expected the staged name to be taken, got %q", name)
+	}
+	waitStatus(t, task, StatusCompleted)
+	assertFile(t, filepath.Join(dir, "data.tar.gz"+partSuffix), existing)
+}
+
+func TestAddReservesNames(t *testing.T) {
+	srv := newTestServer(t, map[string][]byte{"data.bin": testContent(5000)})
+	dir := t.TempDir()
+	m := NewManager(dir, 0)
+	t.Cleanup(func() { m.Close() })
+
+	// A task created without the manager is checked as it is added.
+	outside, err := NewHttpDownloadTask(dir, srv.URL+"/data.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.Add(srv.URL + "/data.bin"); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.AddTask(outside); err != nil {
+		t.Fatal(err)
+	}
+	if name := outside.GetName(); name != "data (1).bin" {
+		t.Errorf("expected the added task to be renamed, got %q", name)
+	}
+
+	// Tasks added concurrently never share a name.
+	var wg sync.WaitGroup
+	for range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := m.Add(srv.URL + "/data.bin"); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	names := map[string]bool{}
+	for _, task := range m.List() {
+		name := task.GetFiles()[0].GetName()
+		if names[name] {
+			t.Errorf("%q is used by two tasks", name)
+		}
+		names[name] = true
+	}
+}
@@ -0,0 +1,183 @@
+package downloads
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// tokenExpiryDelta is how long before its expiry a token is refreshed, so
+// that it doesn't expire while a request is on its way.
+const tokenExpiryDelta = 30 * time.Second
+
+// Token is a bearer token. A zero Expiry means it doesn't expire.
+type Token struct {
+	AccessToken string
+	Expiry      time.Time
+}
+
+func (t *Token) valid(now time.Time) bool {
+	return t != nil && t.AccessToken != "" && (t.Expiry.IsZero() || now.Add(tokenExpiryDelta).Before(t.Expiry))
+}
+
+// TokenSource fetches new tokens.
+type TokenSource interface {
+	Token(ctx context.Context) (*Token, error)
+}
+
+// tokenCredentials sends the token of a TokenSource as a bearer token,
+// fetching a new one before it expires or when the server rejects it.
+type tokenCredentials struct {
+	source TokenSource
+	mu     sync.Mutex
+	token  *Token
+}
+
+// TokenCredentials returns credentials authenticating requests with the
+// tokens of source.
+func TokenCredentials(source TokenSource) Credentials {
+	return &tokenCredentials{source: source}
+}
+
+func (c *tokenCredentials) Authorize(req *http.Request, unauthorized *http.Response) (bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	sent := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+	// Concurrent requests rejected with the same token only refresh it once.
+	if unauthorized != nil && c.token != nil && c.token.AccessToken == sent {
+		c.token = nil
+	}
+	if !c.token.valid(time.Now()) {
+		token, err := c.source.Token(req.Context())
+		if err != nil {
+			return false, err
+		}
+		c.token = token
+	}
+	req.Header.Set("Authorization", "Bearer "+c.token.AccessToken)
+	return true, nil
+}
+
+// OAuth2Config describes how tokens are requested from an OAuth2 token
+// endpoint, RFC 6749. The refresh token grant is used when RefreshToken is
+// set, the client credentials grant otherwise.
+type OAuth2Config struct {
+	TokenURL     string
+	ClientID     string
+	ClientSecret string
+	Scopes       []string
+	RefreshToken string
+	// Client makes the token requests, http.DefaultClient when nil.
+	Client *http.Client
+}
+
+// oauth2Source requests tokens from a token endpoint. It keeps the refresh
+// token issued with the last token.
+type oauth2Source struct {
+	config       OAuth2Config
+	mu           sync.Mutex
+	refreshToken string
+}
+
+// NewOAuth2TokenSource returns a TokenSource requesting tokens as described
+// by c.
+func NewOAuth2TokenSource(c OAuth2Config) TokenSource {
+	return &oauth2Source{config: c, refreshToken: c.RefreshToken}
+}
+
+// OAuth2 returns credentials authenticating requests with the tokens of an
+// OAuth2 token endpoint.
+func OAuth2(c OAuth2Config) Credentials {
+	return TokenCredentials(NewOAuth2TokenSource(c))
+}
+
+// OAuth2Error is the error response of a token endpoint.
+type OAuth2Error struct {
+	Code        int
+	ErrorCode   string
+	Description string
+}
+
+func (e *OAuth2Error) Error() string {
+	if e.ErrorCode == "" {
+		return fmt.Sprintf("token request failed with status %d", e.Code)
+	}
+	if e.Description == "" {
+		return fmt.Sprintf("token request failed: %s", e.ErrorCode)
+	}
+	return fmt.Sprintf("token request failed: %s: %s", e.ErrorCode, e.Description)
+}
+
+func (s *oauth2Source) Token(ctx context.Context) (*Token, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	form := url.Values{}
+	if s.refreshToken != "" {
+		form.Set("grant_type", "refresh_token")
+		form.Set("refresh_token", s.refreshToken)
+	} else {
+		form.Set("grant_type", "client_credentials")
+	}
+	if len(s.config.Scopes) > 0 {
+		form.Set("scope", strings.Join(s.config.Scopes, " "))
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.config.TokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if s.config.ClientID != "" {
+		req.SetBasicAuth(url.QueryEscape(s.config.ClientID), url.QueryEscape(s.config.ClientSecret))
+	}
+	client := s.config.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+
+	var r struct {
+		AccessToken      string `json:"access_token"`
+		TokenType        string `json:"token_type"`
+		ExpiresIn        int64  `json:"expires_in"`
+		RefreshToken     string `json:"refresh_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	if resp.StatusCode != http.StatusOK {
+		json.Unmarshal(body, &r)
+		return nil, &OAuth2Error{Code: resp.StatusCode, ErrorCode: r.Error, Description: r.ErrorDescription}
+	}
+	if err := json.Unmarshal(body, &r); err != nil {
+		return nil, fmt.Errorf("invalid token response: %w", err)
+	}
+	if r.AccessToken == "" {
+		return nil, errors.New("invalid token response: no access token")
+	}
+	if r.TokenType != "" && !strings.EqualFold(r.TokenType, "bearer") {
+		return nil, fmt.Errorf("unsupported token type %q", r.TokenType)
+	}
+	if r.RefreshToken != "" {
+		s.refreshToken = r.RefreshToken
+	}
+	token := &Token{AccessToken: r.AccessToken}
+	if r.ExpiresIn > 0 {
+		token.Expiry = time.Now().Add(time.Duration(r.ExpiresIn) * time.Second)
+	}
+	return token, nil
+}
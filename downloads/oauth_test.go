@@ -0,0 +1,117 @@
+package downloads
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// tokenEndpoint issues numbered tokens. Every token is accepted for uses
+// requests only, after which it behaves as expired.
+type tokenEndpoint struct {
+	*httptest.Server
+	mu       sync.Mutex
+	grants   []string
+	issued   int
+	uses     int
+	used     map[string]int
+	failWith string
+}
+
+func newTokenEndpoint(t *testing.T, uses int) *tokenEndpoint {
+	t.Helper()
+	e := &tokenEndpoint{uses: uses, used: map[string]int{}}
+	e.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		e.mu.Lock()
+		defer e.mu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		id, secret, _ := r.BasicAuth()
+		if id != "dls" || secret != "s3cret" {
+			e.failWith = "invalid_client"
+		}
+		if e.failWith != "" {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, `{"error": %q}`, e.failWith)
+			return
+		}
+		r.ParseForm()
+		grant := r.PostForm.Get("grant_type")
+		if grant == "refresh_token" {
+			grant += ":" + r.PostForm.Get("refresh_token")
+		}
+		e.grants = append(e.grants, grant)
+		e.issued++
+		json.NewEncoder(w).Encode(map[string]any{
+			"access_token":  fmt.Sprintf("token-%d", e.issued),
+			"token_type":    "Bearer",
+			"expires_in":    3600,
+			"refresh_token": fmt.Sprintf("refresh-%d", e.issued),
+		})
+	}))
+	t.Cleanup(e.Close)
+	return e
+}
+
+// authorize checks the bearer token of r.
+func (e *tokenEndpoint) authorize(w http.ResponseWriter, r *http.Request) bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || token != fmt.Sprintf("token-%d", e.issued) || e.used[token] >= e.uses {
+		w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+		return false
+	}
+	e.used[token]++
+	return true
+}
+
+func TestOAuth2ClientCredentials(t *testing.T) {
+	content := testContent(100000)
+	tokens := newTokenEndpoint(t, 1)
+	srv, _ := newAuthServer(t, content, tokens.authorize)
+	credentials := OAuth2(OAuth2Config{TokenURL: tokens.URL, ClientID: "dls", ClientSecret: "s3cret", Scopes: []string{"read"}})
+
+	// Every token expires after a single request, so the download only
+	// completes by refreshing it.
+	dir := downloadWith(t, credentials, srv.URL+"/secret.bin")
+	assertFile(t, filepath.Join(dir, "secret.bin"), content)
+	tokens.mu.Lock()
+	defer tokens.mu.Unlock()
+	if tokens.issued < 2 {
+		t.Errorf("expected the token to be refreshed, %d issued", tokens.issued)
+	}
+	if tokens.grants[0] != "client_credentials" {
+		t.Errorf("unexpected grant %q", tokens.grants[0])
+	}
+}
+
+func TestOAuth2RefreshToken(t *testing.T) {
+	tokens := newTokenEndpoint(t, 1)
+	source := NewOAuth2TokenSource(OAuth2Config{TokenURL: tokens.URL, ClientID: "dls", ClientSecret: "s3cret", RefreshToken: "refresh-0"})
+	for range 2 {
+		token, err := source.Token(t.Context())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !token.valid(time.Now()) || token.valid(time.Now().Add(time.Hour)) {
+			t.Errorf("unexpected expiry %s", token.Expiry)
+		}
+	}
+	if got := strings.Join(tokens.grants, " "); got != "refresh_token:refresh-0 refresh_token:refresh-1" {
+		t.Errorf("the refresh token was not rotated: %s", got)
+	}
+
+	tokens.failWith = "invalid_grant"
+	_, err := source.Token(t.Context())
+	var oauthErr *OAuth2Error
+	if !errors.As(err, &oauthErr) || oauthErr.ErrorCode != "invalid_grant" {
+		t.Errorf("expected an invalid_grant error, got %v", err)
+	}
+}
@@ -0,0 +1,100 @@
+package downloads
+
+import (
+	"context"
+	"net/http"
+)
+
+// ProbeResult describes how a remote file would be downloaded.
+type ProbeResult struct {
+	// URL is the URL of the file after redirects.
+	URL string `json:"url"`
+	// Name is the name the file would be saved as.
+	Name string `json:"name"`
+	// Size is UnknownTotal when the server doesn't send it.
+	Size         int    `json:"size"`
+	ContentType  string `json:"content_type,omitempty"`
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"last_modified,omitempty"`
+	// Checksum is the digest sent by the server, formatted as
+	// "algorithm:hexdigest".
+	Checksum string `json:"checksum,omitempty"`
+	// Resumable reports whether the server supports range requests, so
+	// that the download can be resumed.
+	Resumable bool `json:"resumable"`
+	// Segmented reports whether the file is large enough to be downloaded
+	// over several connections.
+	Segmented bool `json:"segmented"`
+}
+
+// Probe requests the headers of the file at rawURL without downloading it.
+func Probe(ctx context.Context, rawURL string) (*ProbeResult, error) {
+	return probe(ctx, defaultHttpClient, rawURL)
+}
+
+// ProbeWithClient probes rawURL with the client described by c.
+func ProbeWithClient(ctx context.Context, c ClientConfig, rawURL string) (*ProbeResult, error) {
+	return probe(ctx, newHttpClient(c), rawURL)
+}
+
+func probe(ctx context.Context, client *httpClient, rawURL string) (*ProbeResult, error) {
+	f := &HttpDownloadFile{URL: rawURL, task: &HttpDownloadTask{ctx: ctx, client: client}}
+	resp, err := f.probe(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if err := f.parseResponse(resp); err != nil {
+		return nil, err
+	}
+	r := &ProbeResult{
+		URL:          resp.Request.URL.String(),
+		Name:         f.Name,
+		Size:         f.Total,
+		ContentType:  resp.Header.Get("Content-Type"),
+		ETag:         f.etag,
+		LastModified: f.lastModified,
+		Resumable:    f.resumable,
+		Segmented:    f.resumable && f.Total >= 2*minSegmentSize,
+	}
+	if f.checksum != nil {
+		r.Checksum = f.checksum.String()
+	}
+	return r, nil
+}
+
+// probe requests the headers of the file with a HEAD request. When the
+// server refuses HEAD requests or leaves out the size or range support, it
+// requests the first byte of the file instead.
+func (f *HttpDownloadFile) probe(ctx context.Context) (*http.Response, error) {
+	resp, err := f.makeHeadRequest(ctx)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case resp.StatusCode == http.StatusForbidden, resp.StatusCode == http.StatusMethodNotAllowed, resp.StatusCode == http.StatusNotImplemented:
+	case resp.StatusCode >= 200 && resp.StatusCode < 300 && (resp.ContentLength <= 0 || resp.Header.Get("Accept-Ranges") == ""):
+	default:
+		return resp, nil
+	}
+	resp.Body.Close()
+	resp, err = f.makeFirstByteRequest(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusOK {
+		// The server ignored the range.
+		f.rangesIgnored = true
+	}
+	return resp, nil
+}
+
+func (f *HttpDownloadFile) makeFirstByteRequest(ctx context.Context) (*http.Response, error) {
+	client := f.task.httpClient()
+	req, err := client.newRequest(ctx, http.MethodGet, f.URL)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Range", "bytes=0-0")
+	return client.do(req)
+}
@@ -0,0 +1,94 @@
+package downloads
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestProbe(t *testing.T) {
+	setMinSegmentSize(t, 1000)
+	content := testContent(5000)
+	modified := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	files := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", `"v1"`)
+		w.Header().Set("Content-Type", "application/x-iso9660-image")
+		http.ServeContent(w, r, "image.iso", modified, bytes.NewReader(content))
+	}))
+	t.Cleanup(files.Close)
+	srv := httptest.NewServer(http.RedirectHandler(files.URL+"/image.iso", http.StatusFound))
+	t.Cleanup(srv.Close)
+
+	r, err := Probe(t.Context(), srv.URL+"/latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := ProbeResult{
+		URL:          files.URL + "/image.iso",
+		Name:         "image.iso",
+		Size:         len(content),
+		ContentType:  "application/x-iso9660-image",
+		ETag:         `"v1"`,
+		LastModified: modified.Format(http.TimeFormat),
+		Resumable:    true,
+		Segmented:    true,
+	}
+	if *r != expected {
+		t.Errorf("expected %+v, got %+v", expected, *r)
+	}
+}
+
+func TestProbeWithoutHead(t *testing.T) {
+	content := testContent(5000)
+	// Neither server answers HEAD requests, the second one ignores ranges.
+	ranges := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodHead {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Disposition", `attachment; filename="ranges.bin"`)
+		http.ServeContent(w, r, "ranges.bin", time.Time{}, bytes.NewReader(content))
+	}))
+	t.Cleanup(ranges.Close)
+	noRanges := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodHead {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Accept-Ranges", "bytes")
+		w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+		w.Write(content)
+	}))
+	t.Cleanup(noRanges.Close)
+
+	for _, c := range []struct {
+		url       string
+		resumable bool
+	}{
+		{ranges.URL + "/ranges.bin", true},
+		{noRanges.URL + "/no-ranges.bin", false},
+	} {
+		r, err := Probe(t.Context(), c.url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r.Size != len(content) || r.Resumable != c.resumable {
+			t.Errorf("%s: unexpected result %+v", c.url, *r)
+		}
+	}
+
+	dir := t.TempDir()
+	task, err := NewHttpDownloadTask(dir, ranges.URL+"/ranges.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := task.Start(); err != nil {
+		t.Fatal(err)
+	}
+	waitStatus(t, task, StatusCompleted)
+	assertFile(t, filepath.Join(dir, "ranges.bin"), content)
+}
@@ -0,0 +1,562 @@
+package downloads
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Proxies are chosen per request by the Proxy func of a ClientConfig. Besides
+// http.ProxyURL and http.ProxyFromEnvironment, a request can be routed by a
+// static ProxyList or by a proxy auto-config script through PACProxy.
+// SOCKS5 proxies are given with the socks5:// scheme, credentials in the
+// URL; host names are resolved by the proxy.
+
+// ProxyRule routes the requests to hosts matching Host, a shell expression
+// as in PAC files, through Proxy. A nil Proxy connects directly.
+type ProxyRule struct {
+	Host  string
+	Proxy *url.URL
+}
+
+// ProxyList returns a proxy func which uses the first rule matching the
+// host of a request, and connects directly when none does.
+func ProxyList(rules ...ProxyRule) func(*http.Request) (*url.URL, error) {
+	return func(req *http.Request) (*url.URL, error) {
+		host := req.URL.Hostname()
+		for _, r := range rules {
+			if shExpMatch(host, r.Host) {
+				return r.Proxy, nil
+			}
+		}
+		return nil, nil
+	}
+}
+
+// PACEvaluator runs the FindProxyForURL function of a proxy auto-config file.
+// Real-world PAC files are JavaScript programs using variables, string
+// methods and helpers such as dnsResolve, myIpAddress or timeRange; they
+// need an evaluator backed by a JavaScript engine. PAC only covers simple
+// scripts.
+type PACEvaluator interface {
+	FindProxyForURL(url, host string) (string, error)
+}
+
+// PACProxy returns a proxy func which asks e for the proxy of every request.
+// Only the first proxy of the answer is used, the others are fallbacks this
+// client doesn't try.
+func PACProxy(e PACEvaluator) func(*http.Request) (*url.URL, error) {
+	return func(req *http.Request) (*url.URL, error) {
+		result, err := e.FindProxyForURL(req.URL.String(), req.URL.Hostname())
+		if err != nil {
+			return nil, err
+		}
+		return parsePACResult(result)
+	}
+}
+
+// parsePACResult returns the first proxy of a FindProxyForURL answer such
+// as "PROXY proxy:8080; DIRECT", nil for DIRECT.
+func parsePACResult(result string) (*url.URL, error) {
+	first, _, _ := strings.Cut(result, ";")
+	fields := strings.Fields(first)
+	if len(fields) == 0 || strings.EqualFold(fields[0], "DIRECT") {
+		return nil, nil
+	}
+	if len(fields) != 2 {
+		return nil, fmt.Errorf("invalid PAC result %q", result)
+	}
+	var scheme string
+	switch strings.ToUpper(fields[0]) {
+	case "PROXY", "HTTP":
+		scheme = "http"
+	case "HTTPS":
+		scheme = "https"
+	case "SOCKS", "SOCKS5":
+		scheme = "socks5"
+	default:
+		return nil, fmt.Errorf("unsupported PAC proxy type %q", fields[0])
+	}
+	return &url.URL{Scheme: scheme, Host: fields[1]}, nil
+}
+
+// PAC evaluates simple proxy auto-config scripts without a JavaScript
+// engine. It only understands FindProxyForURL functions made of if
+// and else statements, return statements of string literals, ||, && and !,
+// == and != comparisons of url and host with strings, and the shExpMatch,
+// dnsDomainIs, isPlainHostName, localHostOrDomainIs and isInNet helpers.
+// ParsePAC rejects anything else, including var declarations, string
+// methods and the dnsResolve, myIpAddress, isResolvable, dnsDomainLevels,
+// weekdayRange and timeRange helpers: such scripts need a PACEvaluator
+// backed by a JavaScript engine.
+type PAC struct {
+	// Resolver looks up the host names isInNet compares, net.DefaultResolver
+	// when nil. Every lookup times out after pacLookupTimeout.
+	Resolver PACResolver
+
+	params [2]string
+	body   []pacNode
+}
+
+// PACResolver looks up the addresses of host names, *net.Resolver
+// implements it.
+type PACResolver interface {
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+}
+
+// pacLookupTimeout bounds the DNS lookups of a script, which run for every
+// request.
+const pacLookupTimeout = 2 * time.Second
+
+// lookupIP returns the first address of host, nil when it can't be resolved.
+func (p *PAC) lookupIP(host string) net.IP {
+	var r PACResolver = net.DefaultResolver
+	if p.Resolver != nil {
+		r = p.Resolver
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), pacLookupTimeout)
+	defer cancel()
+	addrs, err := r.LookupIPAddr(ctx, host)
+	if err != nil || len(addrs) == 0 {
+		return nil
+	}
+	return addrs[0].IP
+}
+
+var ErrPACUnsupported = errors.New("unsupported PAC script")
+
+// ParsePAC parses a proxy auto-config script.
+func ParsePAC(script string) (*PAC, error) {
+	tokens, err := tokenizePAC(script)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrPACUnsupported, err)
+	}
+	p := &pacParser{tokens: tokens}
+	pac, err := p.script()
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrPACUnsupported, err)
+	}
+	return pac, nil
+}
+
+// Proxy returns the proxy of req chosen by the script, so it can be used as
+// the Proxy of a ClientConfig.
+func (p *PAC) Proxy(req *http.Request) (*url.URL, error) {
+	return PACProxy(p)(req)
+}
+
+func (p *PAC) FindProxyForURL(rawURL, host string) (string, error) {
+	vars := map[string]string{p.params[0]: rawURL, p.params[1]: host}
+	result, ok, err := runPAC(p, p.body, vars)
+	if err != nil {
+		return "", err
+	}
+	if !ok {
+		return "DIRECT", nil
+	}
+	return result, nil
+}
+
+type pacToken struct {
+	kind  byte // 'i' identifier, 's' string, 'p' punctuation
+	value string
+}
+
+func tokenizePAC(s string) ([]pacToken, error) {
+	var tokens []pacToken
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch {
+		case unicode.IsSpace(rune(c)):
+			i++
+		case strings.HasPrefix(s[i:], "//"):
+			for i < len(s) && s[i] != '\n' {
+				i++
+			}
+		case strings.HasPrefix(s[i:], "/*"):
+			end := strings.Index(s[i+2:], "*/")
+			if end < 0 {
+				return nil, errors.New("unterminated comment in PAC script")
+			}
+			i += end + 4
+		case c == '"' || c == '\'':
+			end := strings.IndexByte(s[i+1:], c)
+			if end < 0 {
+				return nil, errors.New("unterminated string in PAC script")
+			}
+			tokens = append(tokens, pacToken{'s', s[i+1 : i+1+end]})
+			i += end + 2
+		case c == '_' || c == '$' || unicode.IsLetter(rune(c)):
+			j := i
+			for j < len(s) && (s[j] == '_' || s[j] == '$' || unicode.IsLetter(rune(s[j])) || unicode.IsDigit(rune(s[j]))) {
+				j++
+			}
+			tokens = append(tokens, pacToken{'i', s[i:j]})
+			i = j
+		default:
+			op := string(c)
+			for _, long := range []string{"===", "!==", "==", "!=", "&&", "||"} {
+				if strings.HasPrefix(s[i:], long) {
+					op = long
+					break
+				}
+			}
+			if !strings.Contains("(){};,!", op) && len(op) == 1 {
+				return nil, fmt.Errorf("unexpected %q in PAC script", op)
+			}
+			tokens = append(tokens, pacToken{'p', op})
+			i += len(op)
+		}
+	}
+	return tokens, nil
+}
+
+// pacNode is a statement or an expression of a PAC script.
+type pacNode struct {
+	kind     string // "if", "return", "call", "not", "and", "or", "eq", "ne", "str", "var"
+	value    string
+	children []pacNode
+	// then and els are the branches of an if statement.
+	then, els []pacNode
+}
+
+type pacParser struct {
+	tokens []pacToken
+	pos    int
+}
+
+func (p *pacParser) peek() pacToken {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos]
+	}
+	return pacToken{}
+}
+
+func (p *pacParser) next() pacToken {
+	t := p.peek()
+	p.pos++
+	return t
+}
+
+func (p *pacParser) accept(kind byte, value string) bool {
+	if t := p.peek(); t.kind == kind && t.value == value {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *pacParser) expect(kind byte, value string) error {
+	if !p.accept(kind, value) {
+		return fmt.Errorf("expected %q, got %q", value, p.peek().value)
+	}
+	return nil
+}
+
+func (p *pacParser) ident() (string, error) {
+	t := p.next()
+	if t.kind != 'i' {
+		return "", fmt.Errorf("expected an identifier, got %q", t.value)
+	}
+	return t.value, nil
+}
+
+func (p *pacParser) script() (*PAC, error) {
+	pac := &PAC{}
+	if err := p.expect('i', "function"); err != nil {
+		return nil, err
+	}
+	if err := p.expect('i', "FindProxyForURL"); err != nil {
+		return nil, err
+	}
+	if err := p.expect('p', "("); err != nil {
+		return nil, err
+	}
+	var err error
+	if pac.params[0], err = p.ident(); err != nil {
+		return nil, err
+	}
+	if err := p.expect('p', ","); err != nil {
+		return nil, err
+	}
+	if pac.params[1], err = p.ident(); err != nil {
+		return nil, err
+	}
+	if err := p.expect('p', ")"); err != nil {
+		return nil, err
+	}
+	if pac.body, err = p.block(); err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.tokens) {
+		return nil, fmt.Errorf("unexpected %q after FindProxyForURL", p.peek().value)
+	}
+	return pac, nil
+}
+
+func (p *pacParser) block() ([]pacNode, error) {
+	if !p.accept('p', "{") {
+		s, err := p.statement()
+		return []pacNode{s}, err
+	}
+	var nodes []pacNode
+	for !p.accept('p', "}") {
+		if p.pos >= len(p.tokens) {
+			return nil, errors.New("unterminated block")
+		}
+		s, err := p.statement()
+		if err != nil {
+			return nil, err
+		}
+		nodes = append(nodes, s)
+	}
+	return nodes, nil
+}
+
+func (p *pacParser) statement() (pacNode, error) {
+	switch {
+	case p.accept('i', "if"):
+		if err := p.expect('p', "("); err != nil {
+			return pacNode{}, err
+		}
+		cond, err := p.or()
+		if err != nil {
+			return pacNode{}, err
+		}
+		if err := p.expect('p', ")"); err != nil {
+			return pacNode{}, err
+		}
+		n := pacNode{kind: "if", children: []pacNode{cond}}
+		if n.then, err = p.block(); err != nil {
+			return pacNode{}, err
+		}
+		if p.accept('i', "else") {
+			if n.els, err = p.block(); err != nil {
+				return pacNode{}, err
+			}
+		}
+		return n, nil
+	case p.accept('i', "return"):
+		value, err := p.or()
+		if err != nil {
+			return pacNode{}, err
+		}
+		p.accept('p', ";")
+		return pacNode{kind: "return", children: []pacNode{value}}, nil
+	}
+	return pacNode{}, fmt.Errorf("unsupported statement starting with %q", p.peek().value)
+}
+
+func (p *pacParser) or() (pacNode, error) {
+	return p.binary("||", "or", p.and)
+}
+
+func (p *pacParser) and() (pacNode, error) {
+	return p.binary("&&", "and", p.comparison)
+}
+
+func (p *pacParser) binary(op, kind string, operand func() (pacNode, error)) (pacNode, error) {
+	left, err := operand()
+	if err != nil {
+		return pacNode{}, err
+	}
+	for p.accept('p', op) {
+		right, err := operand()
+		if err != nil {
+			return pacNode{}, err
+		}
+		left = pacNode{kind: kind, children: []pacNode{left, right}}
+	}
+	return left, nil
+}
+
+func (p *pacParser) comparison() (pacNode, error) {
+	left, err := p.unary()
+	if err != nil {
+		return pacNode{}, err
+	}
+	for _, op := range []struct{ token, kind string }{{"==", "eq"}, {"===", "eq"}, {"!=", "ne"}, {"!==", "ne"}} {
+		if p.accept('p', op.token) {
+			right, err := p.unary()
+			if err != nil {
+				return pacNode{}, err
+			}
+			return pacNode{kind: op.kind, children: []pacNode{left, right}}, nil
+		}
+	}
+	return left, nil
+}
+
+func (p *pacParser) unary() (pacNode, error) {
+	if p.accept('p', "!") {
+		n, err := p.unary()
+		return pacNode{kind: "not", children: []pacNode{n}}, err
+	}
+	if p.accept('p', "(") {
+		n, err := p.or()
+		if err != nil {
+			return pacNode{}, err
+		}
+		return n, p.expect('p', ")")
+	}
+	t := p.next()
+	switch t.kind {
+	case 's':
+		return pacNode{kind: "str", value: t.value}, nil
+	case 'i':
+		if !p.accept('p', "(") {
+			return pacNode{kind: "var", value: t.value}, nil
+		}
+		if _, ok := pacFuncs[t.value]; !ok {
+			return pacNode{}, fmt.Errorf("unsupported function %s", t.value)
+		}
+		n := pacNode{kind: "call", value: t.value}
+		for !p.accept('p', ")") {
+			if len(n.children) > 0 {
+				if err := p.expect('p', ","); err != nil {
+					return pacNode{}, err
+				}
+			}
+			arg, err := p.or()
+			if err != nil {
+				return pacNode{}, err
+			}
+			n.children = append(n.children, arg)
+		}
+		return n, nil
+	}
+	return pacNode{}, fmt.Errorf("unexpected %q", t.value)
+}
+
+// pacFuncs are the PAC helpers supported by PAC, taking and returning strings.
+// Booleans are "true" or "".
+var pacFuncs = map[string]func(p *PAC, args []string) (string, error){
+	"shExpMatch": func(_ *PAC, args []string) (string, error) {
+		return pacBool(len(args) == 2 && shExpMatch(args[0], args[1])), nil
+	},
+	"dnsDomainIs": func(_ *PAC, args []string) (string, error) {
+		return pacBool(len(args) == 2 && strings.HasSuffix(strings.ToLower(args[0]), strings.ToLower(args[1]))), nil
+	},
+	"isPlainHostName": func(_ *PAC, args []string) (string, error) {
+		return pacBool(len(args) == 1 && !strings.Contains(args[0], ".")), nil
+	},
+	"localHostOrDomainIs": func(_ *PAC, args []string) (string, error) {
+		if len(args) != 2 {
+			return "", nil
+		}
+		host, domain := strings.ToLower(args[0]), strings.ToLower(args[1])
+		return pacBool(host == domain || !strings.Contains(host, ".") && strings.HasPrefix(domain, host+".")), nil
+	},
+	"isInNet": func(p *PAC, args []string) (string, error) {
+		if len(args) != 3 {
+			return "", nil
+		}
+		ip := net.ParseIP(args[0])
+		if ip == nil {
+			if ip = p.lookupIP(args[0]); ip == nil {
+				return "", nil
+			}
+		}
+		pattern, mask := net.ParseIP(args[1]), net.ParseIP(args[2])
+		if pattern == nil || mask == nil || ip.To4() == nil || pattern.To4() == nil {
+			return "", nil
+		}
+		m := net.IPMask(mask.To4())
+		return pacBool(ip.To4().Mask(m).Equal(pattern.To4().Mask(m))), nil
+	},
+}
+
+func pacBool(b bool) string {
+	if b {
+		return "true"
+	}
+	return ""
+}
+
+// runPAC runs statements and returns the value of the return statement
+// reached, if any.
+func runPAC(p *PAC, nodes []pacNode, vars map[string]string) (string, bool, error) {
+	for _, n := range nodes {
+		switch n.kind {
+		case "return":
+			v, err := evalPAC(p, n.children[0], vars)
+			return v, true, err
+		case "if":
+			cond, err := evalPAC(p, n.children[0], vars)
+			if err != nil {
+				return "", false, err
+			}
+			branch := n.els
+			if cond != "" {
+				branch = n.then
+			}
+			if v, ok, err := runPAC(p, branch, vars); ok || err != nil {
+				return v, ok, err
+			}
+		}
+	}
+	return "", false, nil
+}
+
+func evalPAC(p *PAC, n pacNode, vars map[string]string) (string, error) {
+	switch n.kind {
+	case "str":
+		return n.value, nil
+	case "var":
+		v, ok := vars[n.value]
+		if !ok {
+			return "", fmt.Errorf("undefined variable %s in PAC script", n.value)
+		}
+		return v, nil
+	case "call":
+		var args []string
+		for _, c := range n.children {
+			v, err := evalPAC(p, c, vars)
+			if err != nil {
+				return "", err
+			}
+			args = append(args, v)
+		}
+		return pacFuncs[n.value](p, args)
+	case "and", "or":
+		left, err := evalPAC(p, n.children[0], vars)
+		if err != nil || (left == "") == (n.kind == "and") {
+			return left, err
+		}
+		return evalPAC(p, n.children[1], vars)
+	}
+	var values []string
+	for _, c := range n.children {
+		v, err := evalPAC(p, c, vars)
+		if err != nil {
+			return "", err
+		}
+		values = append(values, v)
+	}
+	switch n.kind {
+	case "not":
+		return pacBool(values[0] == ""), nil
+	case "eq":
+		return pacBool(values[0] == values[1]), nil
+	case "ne":
+		return pacBool(values[0] != values[1]), nil
+	}
+	return "", fmt.Errorf("unsupported PAC expression %s", n.kind)
+}
+
+// shExpMatch matches s against a shell expression with * and ? wildcards.
+func shExpMatch(s, pattern string) bool {
+	// path.Match treats / specially, which shell expressions don't.
+	s = strings.ReplaceAll(s, "/", "\x00")
+	pattern = strings.ReplaceAll(pattern, "/", "\x00")
+	pattern = strings.NewReplacer("[", "\\[", "]", "\\]", "\\", "\\\\").Replace(pattern)
+	ok, _ := path.Match(pattern, s)
+	return ok
+}
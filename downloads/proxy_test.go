@@ -0,0 +1,228 @@
+package downloads
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+// socksServer is a SOCKS5 server accepting CONNECT requests with
+// username/password authentication. It connects every host name to target,
+// so requests only succeed when the proxy resolves names.
+type socksServer struct {
+	net.Listener
+	user, password string
+	target         string
+	mu             sync.Mutex
+	hosts          []string
+}
+
+func newSocksServer(t *testing.T, user, password, target string) *socksServer {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &socksServer{Listener: l, user: user, password: password, target: target}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *socksServer) serve(conn net.Conn) {
+	defer conn.Close()
+	host, err := s.handshake(conn)
+	if err != nil {
+		return
+	}
+	s.mu.Lock()
+	s.hosts = append(s.hosts, host)
+	s.mu.Unlock()
+	target, err := net.Dial("tcp", s.target)
+	if err != nil {
+		conn.Write([]byte{5, 5, 0, 1, 0, 0, 0, 0, 0, 0})
+		return
+	}
+	defer target.Close()
+	conn.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+	go io.Copy(target, conn)
+	io.Copy(conn, target)
+}
+
+// handshake authenticates the client and returns the host it connects to.
+func (s *socksServer) handshake(conn net.Conn) (string, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return "", err
+	}
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return "", err
+	}
+	// Username/password authentication, RFC 1929.
+	conn.Write([]byte{5, 2})
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return "", err
+	}
+	user := make([]byte, header[1])
+	io.ReadFull(conn, user)
+	n := make([]byte, 1)
+	io.ReadFull(conn, n)
+	password := make([]byte, n[0])
+	if _, err := io.ReadFull(conn, password); err != nil {
+		return "", err
+	}
+	if string(user) != s.user || string(password) != s.password {
+		conn.Write([]byte{1, 1})
+		return "", errors.New("authentication failed")
+	}
+	conn.Write([]byte{1, 0})
+
+	request := make([]byte, 4)
+	if _, err := io.ReadFull(conn, request); err != nil {
+		return "", err
+	}
+	if request[1] != 1 || request[3] != 3 {
+		conn.Write([]byte{5, 8, 0, 1, 0, 0, 0, 0, 0, 0})
+		return "", errors.New("only CONNECT to host names is supported")
+	}
+	io.ReadFull(conn, n)
+	host := make([]byte, n[0])
+	io.ReadFull(conn, host)
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(conn, port); err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(string(host), strconv.Itoa(int(binary.BigEndian.Uint16(port)))), nil
+}
+
+func (s *socksServer) connectedHosts() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.hosts...)
+}
+
+func TestSocks5Proxy(t *testing.T) {
+	content := testContent(10000)
+	srv := newTestServer(t, map[string][]byte{"a.bin": content})
+	socks := newSocksServer(t, "user", "secret", srv.Listener.Addr().String())
+	dir := t.TempDir()
+
+	proxyURL := &url.URL{Scheme: "socks5", User: url.UserPassword("user", "secret"), Host: socks.Addr().String()}
+	config := ClientConfig{Proxy: ProxyList(ProxyRule{Host: "*.internal", Proxy: proxyURL})}
+	task, err := NewHttpDownloadTaskWithClient(t.Context(), config, dir, "http://mirror.internal:8080/a.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := task.Start(); err != nil {
+		t.Fatal(err)
+	}
+	waitStatus(t, task, StatusCompleted)
+	assertFile(t, filepath.Join(dir, "a.bin"), content)
+	hosts := socks.connectedHosts()
+	if len(hosts) == 0 || hosts[0] != "mirror.internal:8080" {
+		t.Errorf("the proxy didn't resolve the host name: %q", hosts)
+	}
+
+	proxyURL.User = url.UserPassword("user", "wrong")
+	config = ClientConfig{Proxy: http.ProxyURL(proxyURL)}
+	if _, err := NewHttpDownloadTaskWithClient(t.Context(), config, dir, "http://mirror.internal:8080/a.bin"); err == nil {
+		t.Errorf("expected wrong proxy credentials to fail")
+	}
+}
+
+const testPAC = `
+// Internal mirrors go through SOCKS, everything else through the proxy.
+function FindProxyForURL(url, host) {
+	if (isPlainHostName(host) || dnsDomainIs(host, ".local"))
+		return "DIRECT";
+	if (shExpMatch(host, "*.internal") && !shExpMatch(url, "*/public/*")) {
+		return "SOCKS5 socks.example:1080; DIRECT";
+	} else if (host == "10.1.2.3" || isInNet(host, "192.168.0.0", "255.255.0.0")) {
+		return 'PROXY lan-proxy:3128';
+	}
+	/* default */
+	return "PROXY proxy.example:8080";
+}
+`
+
+// fakeResolver resolves the host names of hosts and no others.
+type fakeResolver struct {
+	hosts map[string]string
+	// noDeadline is set when a lookup was made without a deadline.
+	noDeadline bool
+}
+
+func (r *fakeResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	if _, ok := ctx.Deadline(); !ok {
+		r.noDeadline = true
+	}
+	addr, ok := r.hosts[host]
+	if !ok {
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	return []net.IPAddr{{IP: net.ParseIP(addr)}}, nil
+}
+
+func TestPAC(t *testing.T) {
+	pac, err := ParsePAC(testPAC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resolver := &fakeResolver{hosts: map[string]string{"nas.home": "192.168.1.10"}}
+	pac.Resolver = resolver
+	cases := map[string]string{
+		"http://intranet/file":                "",
+		"http://files.local/file":             "",
+		"http://mirror.internal/file":         "socks5://socks.example:1080",
+		"http://mirror.internal/public/file":  "http://proxy.example:8080",
+		"http://10.1.2.3/file":                "http://lan-proxy:3128",
+		"http://192.168.4.5:8080/file":        "http://lan-proxy:3128",
+		"http://nas.home/file":                "http://lan-proxy:3128",
+		"https://downloads.example.com/a.iso": "http://proxy.example:8080",
+	}
+	for rawURL, expected := range cases {
+		req, _ := http.NewRequest(http.MethodGet, rawURL, nil)
+		proxy, err := pac.Proxy(req)
+		if err != nil {
+			t.Errorf("%s: %v", rawURL, err)
+			continue
+		}
+		got := ""
+		if proxy != nil {
+			got = proxy.String()
+		}
+		if got != expected {
+			t.Errorf("%s: expected proxy %q, got %q", rawURL, expected, got)
+		}
+	}
+	if resolver.noDeadline {
+		t.Errorf("isInNet looked a host up without a timeout")
+	}
+
+	for _, script := range []string{
+		`function FindProxyForURL(url, host) { var x = 1; return "DIRECT"; }`,
+		`function FindProxyForURL(url, host) { return myIpAddress(); }`,
+		`function Other(url, host) { return "DIRECT"; }`,
+	} {
+		if _, err := ParsePAC(script); !errors.Is(err, ErrPACUnsupported) {
+			t.Errorf("expected ErrPACUnsupported for %q, got %v", script, err)
+		}
+	}
+}
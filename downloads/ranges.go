@@ -0,0 +1,45 @@
+package downloads
+
+import "errors"
+
+// RangeFallback decides how a resumed download continues when the server
+// answers its range request with the whole file.
+type RangeFallback string
+
+const (
+	// RangeFallbackRestart truncates the file and downloads it again from
+	// the start over a single connection.
+	RangeFallbackRestart RangeFallback = "restart"
+	// RangeFallbackSkip reads the whole file again but discards the bytes
+	// already downloaded instead of writing them, so only the rest is
+	// written.
+	RangeFallbackSkip RangeFallback = "skip"
+)
+
+var errRangeIgnored = errors.New("the server ignored the range request")
+
+// ignoreRanges stops using range requests for the file and downloads it
+// again from the start. f.mu must be held.
+func (f *HttpDownloadFile) ignoreRanges() {
+	f.rangesIgnored = true
+	f.resumable = false
+	f.restart = true
+	f.cancel()
+}
+
+// SetRangeFallback sets how a resumed download continues when the server
+// ignores its range requests. The default is RangeFallbackRestart.
+func (dt *HttpDownloadTask) SetRangeFallback(fallback RangeFallback) {
+	dt.mu.Lock()
+	defer dt.mu.Unlock()
+	dt.rangeFallback = fallback
+}
+
+func (dt *HttpDownloadTask) GetRangeFallback() RangeFallback {
+	dt.mu.Lock()
+	defer dt.mu.Unlock()
+	if dt.rangeFallback == "" {
+		return RangeFallbackRestart
+	}
+	return dt.rangeFallback
+}
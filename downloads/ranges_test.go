@@ -0,0 +1,86 @@
+package downloads
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+// resumeIgnoringRanges restores a download of which downloaded bytes are
+// on disk from a server that advertises range support but always answers
+// with the whole file. It returns the task, its directory and the Range
+// headers of the GET requests.
+func resumeIgnoringRanges(t *testing.T, content, onDisk []byte, downloaded int, fallback RangeFallback) (DownloadTask, string, func() []string) {
+	t.Helper()
+	var mu sync.Mutex
+	var ranges []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			mu.Lock()
+			ranges = append(ranges, r.Header.Get("Range"))
+			mu.Unlock()
+		}
+		w.Header().Set("Accept-Ranges", "bytes")
+		w.Header().Set("ETag", `"v1"`)
+		w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+		w.Write(content)
+	}))
+	t.Cleanup(srv.Close)
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "iso.bin"+partSuffix), onDisk, 0666); err != nil {
+		t.Fatal(err)
+	}
+	saved := TaskState{
+		Id:            uuid.New(),
+		Type:          DownloadTaskTypeHTTP,
+		Name:          "iso.bin",
+		Path:          dir,
+		Status:        StatusStarted,
+		RangeFallback: fallback,
+		Files: []FileState{{
+			Id:         uuid.New(),
+			Name:       "iso.bin",
+			Path:       dir,
+			URL:        srv.URL + "/iso.bin",
+			Downloaded: downloaded,
+			Total:      len(content),
+			Status:     StatusStarted,
+			Resumable:  true,
+			ETag:       `"v1"`,
+		}},
+	}
+	return loadSaved(t, dir, saved), dir, func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string(nil), ranges...)
+	}
+}
+
+func TestRangeIgnoredRestarts(t *testing.T) {
+	content := testContent(50000)
+	// The data on disk is longer than the file and must be truncated.
+	onDisk := bytes.Repeat([]byte{0xff}, 60000)
+	task, dir, ranges := resumeIgnoringRanges(t, content, onDisk, 20000, RangeFallbackRestart)
+	waitStatus(t, task, StatusCompleted)
+	assertFile(t, filepath.Join(dir, "iso.bin"), content)
+	if r := ranges(); len(r) != 2 || r[0] != "bytes=20000-" || r[1] != "" {
+		t.Errorf("expected a range request followed by a full one, got %q", r)
+	}
+}
+
+func TestRangeIgnoredSkips(t *testing.T) {
+	content := testContent(50000)
+	task, dir, ranges := resumeIgnoringRanges(t, content, content[:20000], 20000, RangeFallbackSkip)
+	waitStatus(t, task, StatusCompleted)
+	assertFile(t, filepath.Join(dir, "iso.bin"), content)
+	if r := ranges(); len(r) != 1 || r[0] != "bytes=20000-" {
+		t.Errorf("expected a single request, got %q", r)
+	}
+}
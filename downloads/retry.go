@@ -0,0 +1,145 @@
+package downloads
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"slices"
+	"syscall"
+	"time"
+)
+
+// StatusError is returned when a server answers with an unexpected status
+// code. RetryAfter is the delay asked by its Retry-After header.
+type StatusError struct {
+	Code       int
+	RetryAfter time.Duration
+}
+
+func newStatusError(resp *http.Response) *StatusError {
+	return &StatusError{
+		Code:       resp.StatusCode,
+		RetryAfter: parseRetryAfter(resp.Header, time.Now()),
+	}
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("http download failed with status code %d", e.Code)
+}
+
+// RetryPolicy decides which failures of a download are retried and how long
+// to wait before each retry. Retries resume from the downloaded offset when
+// the server supports ranges and start over otherwise.
+type RetryPolicy struct {
+	// MaxAttempts is the number of times a request is tried in a row
+	// without receiving any data. Zero or one disables retries.
+	MaxAttempts int
+	// InitialDelay is the delay before the first retry. Every following
+	// delay is Multiplier times longer, up to MaxDelay.
+	InitialDelay time.Duration
+	MaxDelay     time.Duration
+	Multiplier   float64
+	// Jitter randomizes every delay by up to this fraction of it.
+	Jitter float64
+	// RetryableStatus lists the response status codes worth retrying.
+	RetryableStatus []int
+	// Retryable overrides the default classification of errors when set.
+	Retryable func(err error) bool
+}
+
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts:  5,
+	InitialDelay: time.Second,
+	MaxDelay:     time.Minute,
+	Multiplier:   2,
+	Jitter:       0.2,
+	RetryableStatus: []int{
+		http.StatusRequestTimeout,
+		http.StatusTooEarly,
+		http.StatusTooManyRequests,
+		http.StatusInternalServerError,
+		http.StatusBadGateway,
+		http.StatusServiceUnavailable,
+		http.StatusGatewayTimeout,
+	},
+}
+
+// Delay returns how long to wait before retrying after attempt failed attempts.
+func (p RetryPolicy) Delay(attempt int) time.Duration {
+	delay := float64(p.InitialDelay)
+	for i := 1; i < attempt; i++ {
+		delay *= max(p.Multiplier, 1)
+		if p.MaxDelay > 0 && delay >= float64(p.MaxDelay) {
+			delay = float64(p.MaxDelay)
+			break
+		}
+	}
+	if p.Jitter > 0 {
+		delay += delay * p.Jitter * (2*rand.Float64() - 1)
+	}
+	return time.Duration(delay)
+}
+
+// IsRetryable reports whether err is a transient failure: a retryable status
+// code, a dropped or refused connection or a timeout.
+func (p RetryPolicy) IsRetryable(err error) bool {
+	if p.Retryable != nil {
+		return p.Retryable(err)
+	}
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) {
+		return slices.Contains(p.RetryableStatus, statusErr.Code)
+	}
+	if errors.Is(err, context.Canceled) {
+		return false
+	}
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, io.EOF) {
+		return true
+	}
+	if errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.EPIPE) {
+		return true
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+	var opErr *net.OpError
+	return errors.As(err, &opErr)
+}
+
+// retry decides whether the file retries after err on its attempt-th
+// failure in a row and waits for the backoff delay, or for the delay asked
+// by the server when it throttles us. It returns false when the error is
+// permanent, the attempts are exhausted or the file is stopped while
+// waiting.
+func (f *HttpDownloadFile) retry(err error, attempt int) bool {
+	policy := f.task.getRetryPolicy()
+	f.mu.Lock()
+	ctx := f.ctx
+	started := f.status == StatusStarted
+	f.mu.Unlock()
+	if !started || ctx.Err() != nil || attempt >= policy.MaxAttempts || !policy.IsRetryable(err) {
+		return false
+	}
+	delay := policy.Delay(attempt)
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) && isThrottling(statusErr.Code) {
+		f.task.hosts().throttle(f.host(), statusErr.RetryAfter)
+		if statusErr.RetryAfter > 0 {
+			delay = statusErr.RetryAfter
+		}
+	}
+	f.task.emit(Event{Type: EventRetry, FileId: f.Id, Err: err, Attempt: attempt})
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
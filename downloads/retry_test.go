@@ -0,0 +1,200 @@
+package downloads
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+var testRetryPolicy = RetryPolicy{
+	MaxAttempts:     3,
+	InitialDelay:    10 * time.Millisecond,
+	Multiplier:      2,
+	RetryableStatus: DefaultRetryPolicy.RetryableStatus,
+}
+
+func TestRetryPolicyDelay(t *testing.T) {
+	p := RetryPolicy{InitialDelay: 10 * time.Millisecond, MaxDelay: 50 * time.Millisecond, Multiplier: 2}
+	for attempt, expected := range []time.Duration{10, 20, 40, 50, 50} {
+		if d := p.Delay(attempt + 1); d != expected*time.Millisecond {
+			t.Errorf("attempt %d: expected %s, got %s", attempt+1, expected*time.Millisecond, d)
+		}
+	}
+	p.Jitter = 0.5
+	for i := 0; i < 100; i++ {
+		if d := p.Delay(1); d < 5*time.Millisecond || d > 15*time.Millisecond {
+			t.Fatalf("delay %s is out of the jitter range", d)
+		}
+	}
+}
+
+func TestRetryPolicyIsRetryable(t *testing.T) {
+	cases := []struct {
+		err       error
+		retryable bool
+	}{
+		{&StatusError{Code: http.StatusServiceUnavailable}, true},
+		{fmt.Errorf("wrapped: %w", &StatusError{Code: http.StatusBadGateway}), true},
+		{&StatusError{Code: http.StatusNotFound}, false},
+		{io.ErrUnexpectedEOF, true},
+		{context.DeadlineExceeded, true},
+		{context.Canceled, false},
+		{errors.New("disk full"), false},
+	}
+	for _, c := range cases {
+		if DefaultRetryPolicy.IsRetryable(c.err) != c.retryable {
+			t.Errorf("%v: expected retryable %v", c.err, c.retryable)
+		}
+	}
+}
+
+// newFlakyServer serves content as "/flaky.bin". The first GET request is
+// answered with status when it isn't zero, otherwise its body is cut after
+// half of the content.
+func newFlakyServer(t *testing.T, content []byte, status int) (*testServer, *atomic.Int32) {
+	t.Helper()
+	var gets atomic.Int32
+	srv := &testServer{}
+	srv.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		srv.mu.Lock()
+		srv.requests = append(srv.requests, r)
+		srv.mu.Unlock()
+		w.Header().Set("Content-Disposition", `attachment; filename="flaky.bin"`)
+		if r.Method == http.MethodGet && gets.Add(1) == 1 {
+			if status != 0 {
+				w.WriteHeader(status)
+				return
+			}
+			w.Header().Set("Accept-Ranges", "bytes")
+			w.Header().Set("Content-Length", fmt.Sprint(len(content)))
+			w.Write(content[:len(content)/2])
+			w.(http.Flusher).Flush()
+			panic(http.ErrAbortHandler)
+		}
+		http.ServeContent(w, r, "flaky.bin", time.Time{}, bytes.NewReader(content))
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &gets
+}
+
+func TestRetryResumesAfterDroppedConnection(t *testing.T) {
+	content := testContent(20000)
+	srv, _ := newFlakyServer(t, content, 0)
+	dir := t.TempDir()
+
+	task, err := NewHttpDownloadTask(dir, srv.URL+"/flaky.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	task.SetRetryPolicy(&testRetryPolicy)
+	retries := make(chan Event, 10)
+	sub := task.SubscribeFunc(func(e Event) {
+		if e.Type == EventRetry {
+			retries <- e
+		}
+	})
+	defer sub.Close()
+	if err := task.Start(); err != nil {
+		t.Fatal(err)
+	}
+	waitStatus(t, task, StatusCompleted)
+	assertFile(t, filepath.Join(dir, "flaky.bin"), content)
+	ranges := srv.rangeRequests()
+	if len(ranges) != 2 || ranges[1] != "bytes=10000-" {
+		t.Errorf("expected a resume from the dropped offset, got %q", ranges)
+	}
+	select {
+	case e := <-retries:
+		if e.Attempt != 1 || !errors.Is(e.Err, io.ErrUnexpectedEOF) {
+			t.Errorf("unexpected retry event %+v", e)
+		}
+	case <-time.After(time.Second):
+		t.Error("no retry event")
+	}
+}
+
+func TestRetryOnServerError(t *testing.T) {
+	content := testContent(20000)
+	srv, _ := newFlakyServer(t, content, http.StatusServiceUnavailable)
+	dir := t.TempDir()
+
+	task, err := NewHttpDownloadTask(dir, srv.URL+"/flaky.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	task.SetRetryPolicy(&testRetryPolicy)
+	if err := task.Start(); err != nil {
+		t.Fatal(err)
+	}
+	waitStatus(t, task, StatusCompleted)
+	assertFile(t, filepath.Join(dir, "flaky.bin"), content)
+}
+
+func TestRetryGivesUp(t *testing.T) {
+	content := testContent(20000)
+	srv, _ := newFlakyServer(t, content, http.StatusServiceUnavailable)
+	dir := t.TempDir()
+
+	task, err := NewHttpDownloadTask(dir, srv.URL+"/flaky.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	task.SetRetryPolicy(&RetryPolicy{MaxAttempts: 1})
+	if err := task.Start(); err != nil {
+		t.Fatal(err)
+	}
+	waitStatus(t, task, StatusFailed)
+	var statusErr *StatusError
+	if !errors.As(task.GetError(), &statusErr) || statusErr.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected a 503 StatusError, got %v", task.GetError())
+	}
+}
+
+// TestRetryWhileScheduling retries with the policy of the manager while the
+// manager schedules its tasks.
+func TestRetryWhileScheduling(t *testing.T) {
+	content := testContent(20000)
+	srv, _ := newFlakyServer(t, content, http.StatusInternalServerError)
+	m := NewManager(t.TempDir(), 1)
+	t.Cleanup(func() { m.Close() })
+	m.SetRetryPolicy(testRetryPolicy)
+
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		for {
+			select {
+			case <-done:
+				return
+			default:
+				m.SetMaxActive(1)
+			}
+		}
+	}()
+	completed := make(chan struct{})
+	sub := m.SubscribeFunc(func(e Event) {
+		if e.Type == EventStatusChanged && e.Status == StatusCompleted {
+			close(completed)
+		}
+	})
+	defer sub.Close()
+	if _, err := m.Add(srv.URL + "/flaky.bin"); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-completed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the task deadlocked")
+	}
+	close(done)
+	<-stopped
+}
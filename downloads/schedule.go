@@ -0,0 +1,197 @@
+package downloads
+
+import (
+	"context"
+	"slices"
+	"time"
+)
+
+// Clock tells the time to schedules. Tests replace it to control time.
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (systemClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+// maxScheduleWait bounds the time between two checks of a schedule, so
+// clock changes are noticed.
+const maxScheduleWait = time.Hour
+
+// ScheduleRule sets the limits of a manager on some days between two times
+// of day, given as offsets from midnight. A rule whose End is before its
+// Start runs past midnight, one whose End equals its Start lasts all day.
+type ScheduleRule struct {
+	// Days lists the days the rule starts on, every day when empty.
+	Days  []time.Weekday
+	Start time.Duration
+	End   time.Duration
+	// RateLimit is the total speed in bytes per second, zero for unlimited.
+	RateLimit int
+	// MaxActive is the number of tasks allowed to run at once, zero or less
+	// for no limit.
+	MaxActive int
+	// Paused puts the started tasks back in the queue and starts none.
+	Paused bool
+}
+
+// Schedule changes the limits of a manager with the time of day. The first
+// rule matching the current time applies, RateLimit and MaxActive apply
+// when none does.
+type Schedule struct {
+	Rules     []ScheduleRule
+	RateLimit int
+	MaxActive int
+}
+
+func (r ScheduleRule) on(day time.Weekday) bool {
+	return len(r.Days) == 0 || slices.Contains(r.Days, day)
+}
+
+func midnight(t time.Time) time.Time {
+	y, m, d := t.Date()
+	return time.Date(y, m, d, 0, 0, 0, 0, t.Location())
+}
+
+func (r ScheduleRule) matches(now time.Time) bool {
+	day := now.Weekday()
+	offset := now.Sub(midnight(now))
+	switch {
+	case r.Start < r.End:
+		return r.on(day) && offset >= r.Start && offset < r.End
+	case r.Start == r.End:
+		return r.on(day)
+	default:
+		// The rule started yesterday and ends today, or starts today.
+		return r.on(day) && offset >= r.Start || r.on((day+6)%7) && offset < r.End
+	}
+}
+
+// rule returns the limits in force at now.
+func (s *Schedule) rule(now time.Time) ScheduleRule {
+	for _, r := range s.Rules {
+		if r.matches(now) {
+			return r
+		}
+	}
+	return ScheduleRule{RateLimit: s.RateLimit, MaxActive: s.MaxActive}
+}
+
+// next returns the first time after now a rule may start or end.
+func (s *Schedule) next(now time.Time) time.Time {
+	next := now.Add(maxScheduleWait)
+	today := midnight(now)
+	for d := 0; d <= 1; d++ {
+		day := today.AddDate(0, 0, d)
+		candidates := []time.Time{day}
+		for _, r := range s.Rules {
+			candidates = append(candidates, day.Add(r.Start), day.Add(r.End))
+		}
+		for _, c := range candidates {
+			if c.After(now) && c.Before(next) {
+				next = c
+			}
+		}
+	}
+	return next
+}
+
+// requeueableTask is implemented by tasks that can go back to the queue
+// without losing their progress.
+type requeueableTask interface {
+	requeue() error
+}
+
+// SetClock replaces the clock schedules are evaluated with.
+func (m *Manager) SetClock(c Clock) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.clock = c
+}
+
+// SetSchedule makes the rate limit and the number of active tasks follow s,
+// overriding SetRateLimit and SetMaxActive whenever the rule in force
+// changes. A nil schedule stops it, keeping the limits last applied.
+func (m *Manager) SetSchedule(s *Schedule) {
+	m.mu.Lock()
+	if m.stopSchedule != nil {
+		m.stopSchedule()
+		m.stopSchedule = nil
+	}
+	clock := m.clock
+	ctx := m.ctx
+	if s != nil {
+		ctx, m.stopSchedule = context.WithCancel(m.ctx)
+	}
+	m.mu.Unlock()
+	if s == nil {
+		m.applyRule(ctx, ScheduleRule{RateLimit: m.GetRateLimit(), MaxActive: m.GetMaxActive()})
+		return
+	}
+	m.applyRule(ctx, s.rule(clock.Now()))
+	go m.runSchedule(ctx, s, clock)
+}
+
+func (m *Manager) runSchedule(ctx context.Context, s *Schedule, clock Clock) {
+	for {
+		now := clock.Now()
+		select {
+		case <-clock.After(s.next(now).Sub(now)):
+		case <-ctx.Done():
+			return
+		}
+		m.applyRule(ctx, s.rule(clock.Now()))
+	}
+}
+
+// applyRule sets the limits of r, requeueing the started tasks when it
+// pauses downloads and the most recently added ones over its MaxActive
+// when it lowers the limit. Nothing changes once ctx, the context of the schedule
+// applying it, is done.
+func (m *Manager) applyRule(ctx context.Context, r ScheduleRule) {
+	m.scheduleMu.Lock()
+	defer m.scheduleMu.Unlock()
+	if ctx.Err() != nil {
+		return
+	}
+	if m.GetRateLimit() != r.RateLimit {
+		m.SetRateLimit(r.RateLimit)
+	}
+	m.mu.Lock()
+	m.maxActive = r.MaxActive
+	m.paused = r.Paused
+	var started []DownloadTask
+	for _, task := range m.tasks {
+		if task.GetStatus() == StatusStarted {
+			started = append(started, task)
+		}
+	}
+	m.mu.Unlock()
+	keep := len(started)
+	if r.Paused {
+		keep = 0
+	} else if r.MaxActive > 0 {
+		keep = min(keep, r.MaxActive)
+	}
+	for i := len(started) - 1; i >= keep; i-- {
+		if t, ok := started[i].(requeueableTask); ok {
+			t.requeue()
+		}
+	}
+	m.schedule()
+}
+
+// GetPaused reports whether the schedule of the manager keeps every task queued.
+func (m *Manager) GetPaused() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.paused
+}
@@ -0,0 +1,186 @@
+package downloads
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeClock only moves when advanced.
+type fakeClock struct {
+	mu      sync.Mutex
+	now     time.Time
+	waiters []fakeWaiter
+}
+
+type fakeWaiter struct {
+	at time.Time
+	ch chan time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ch := make(chan time.Time, 1)
+	c.waiters = append(c.waiters, fakeWaiter{at: c.now.Add(d), ch: ch})
+	return ch
+}
+
+// set moves the clock to now, firing the timers due by then.
+func (c *fakeClock) set(now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = now
+	var pending []fakeWaiter
+	for _, w := range c.waiters {
+		if w.at.After(now) {
+			pending = append(pending, w)
+		} else {
+			w.ch <- now
+		}
+	}
+	c.waiters = pending
+}
+
+// advance moves the clock to now once a timer is waiting for it.
+func (c *fakeClock) advance(t *testing.T, now time.Time) {
+	t.Helper()
+	waitFor(t, "a timer", func() bool {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		return len(c.waiters) > 0
+	})
+	c.set(now)
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+var officeSchedule = &Schedule{
+	Rules: []ScheduleRule{
+		{
+			Days:      []time.Weekday{time.Monday, time.Tuesday, time.Wednesday, time.Thursday, time.Friday},
+			Start:     8 * time.Hour,
+			End:       18 * time.Hour,
+			RateLimit: 500 * 1024,
+			MaxActive: 1,
+		},
+		{Days: []time.Weekday{time.Sunday}, Start: 6 * time.Hour, End: 12 * time.Hour, Paused: true},
+	},
+	MaxActive: 4,
+}
+
+func TestScheduleRule(t *testing.T) {
+	// 2024-01-01 is a Monday.
+	monday := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	cases := []struct {
+		at        time.Time
+		rateLimit int
+		paused    bool
+	}{
+		{monday.Add(7 * time.Hour), 0, false},
+		{monday.Add(8 * time.Hour), 500 * 1024, false},
+		{monday.Add(18 * time.Hour), 0, false},
+		{monday.AddDate(0, 0, 5).Add(10 * time.Hour), 0, false},
+		{monday.AddDate(0, 0, 6).Add(10 * time.Hour), 0, true},
+	}
+	for _, c := range cases {
+		r := officeSchedule.rule(c.at)
+		if r.RateLimit != c.rateLimit || r.Paused != c.paused {
+			t.Errorf("%s: unexpected rule %+v", c.at, r)
+		}
+	}
+
+	night := ScheduleRule{Days: []time.Weekday{time.Monday}, Start: 22 * time.Hour, End: 6 * time.Hour}
+	if !night.matches(monday.Add(23*time.Hour)) || !night.matches(monday.AddDate(0, 0, 1).Add(5*time.Hour)) {
+		t.Errorf("the night rule must run past midnight")
+	}
+	if night.matches(monday.Add(5 * time.Hour)) {
+		t.Errorf("the night rule must not match before it starts")
+	}
+
+	if next := officeSchedule.next(monday.Add(7 * time.Hour)); !next.Equal(monday.Add(8 * time.Hour)) {
+		t.Errorf("expected the next change at 08:00, got %s", next)
+	}
+}
+
+func TestManagerSchedule(t *testing.T) {
+	content := testContent(100000)
+	srv := newSlowServer(t, content, 1000, func(int) time.Duration { return 20 * time.Millisecond })
+	monday := time.Date(2024, 1, 1, 7, 0, 0, 0, time.UTC)
+	clock := &fakeClock{now: monday}
+	m := NewManager(t.TempDir(), 0)
+	m.SetClock(clock)
+	t.Cleanup(func() { m.Close() })
+
+	m.SetSchedule(officeSchedule)
+	if m.GetRateLimit() != 0 || m.GetMaxActive() != 4 {
+		t.Fatalf("expected the default limits, got %d B/s and %d tasks", m.GetRateLimit(), m.GetMaxActive())
+	}
+
+	first, err := m.Add(srv.URL + "/slow.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := m.Add(srv.URL + "/slow.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitDownloaded(t, first, 1000)
+	waitDownloaded(t, second, 1000)
+
+	// Office hours: the most recently added task over the lower limit goes back to the queue.
+	clock.advance(t, monday.Add(time.Hour))
+	waitFor(t, "the office hours limit", func() bool { return m.GetRateLimit() == 500*1024 })
+	if m.GetMaxActive() != 1 {
+		t.Errorf("expected 1 active task, got %d", m.GetMaxActive())
+	}
+	waitStatus(t, second, StatusQueued)
+	if first.GetStatus() != StatusStarted {
+		t.Errorf("expected the oldest task to keep running, got %s", first.GetStatus())
+	}
+	for _, task := range []DownloadTask{first, second} {
+		if err := m.RemoveWithData(task.GetId()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	task, err := m.Add(srv.URL + "/slow.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitDownloaded(t, task, 2000)
+
+	// Sunday morning: the task goes back to the queue with its progress.
+	sunday := time.Date(2024, 1, 7, 0, 0, 0, 0, time.UTC)
+	clock.advance(t, sunday)
+	waitFor(t, "the end of the office hours", func() bool { return m.GetRateLimit() == 0 })
+	clock.advance(t, sunday.Add(7*time.Hour))
+	waitStatus(t, task, StatusQueued)
+	if task.GetDownloaded() == 0 {
+		t.Errorf("the paused task lost its progress")
+	}
+	if !m.GetPaused() {
+		t.Errorf("expected the manager to be paused")
+	}
+
+	clock.advance(t, sunday.Add(12*time.Hour))
+	waitStatus(t, task, StatusCompleted)
+	if ranges := srv.rangeRequests(); len(ranges) == 0 {
+		t.Errorf("the task was not resumed with a range request")
+	}
+}
@@ -0,0 +1,233 @@
+package downloads
+
+import (
+	"context"
+	"dls/si"
+	"math"
+	"slices"
+	"time"
+)
+
+var (
+	// minSegmentSize is the smallest range worth downloading over its own connection.
+	minSegmentSize = int(si.Mebi)
+	// segmentCheckInterval is how often the speeds of running segments are compared.
+	segmentCheckInterval = time.Second
+)
+
+// slowSegmentRatio is how many times slower than the median a segment has
+// to be before its connection is dropped and reopened.
+const slowSegmentRatio = 4
+
+// fileSegment is a byte range [Start, End) of a file downloaded over a
+// separate connection. Downloaded counts the bytes written from Start.
+type fileSegment struct {
+	Start      int
+	End        int
+	Downloaded int
+	active     bool
+	// cancel closes the connection of the segment.
+	cancel  context.CancelFunc
+	dropped bool
+	fresh   bool
+	// speed is the last measured speed in bytes per second, measured from
+	// checkpoint bytes at checkpointAt.
+	speed        float64
+	checkpoint   int
+	checkpointAt time.Time
+	// limiter caps the connection of the segment, its parent is the file limiter.
+	limiter *SpeedLimiter
+}
+
+type SegmentState struct {
+	Start      int `json:"start"`
+	End        int `json:"end"`
+	Downloaded int `json:"downloaded"`
+}
+
+func (s *fileSegment) offset() int {
+	return s.Start + s.Downloaded
+}
+
+func (s *fileSegment) remaining() int {
+	return s.End - s.offset()
+}
+
+// connect records the connection a segment is read from and restarts its speed measurement.
+func (s *fileSegment) connect(cancel context.CancelFunc) {
+	s.cancel = cancel
+	s.fresh = true
+	s.checkpoint = s.Downloaded
+	s.checkpointAt = time.Now()
+}
+
+// measure updates the speed of the segment since the last checkpoint.
+func (s *fileSegment) measure(now time.Time) {
+	if elapsed := now.Sub(s.checkpointAt).Seconds(); elapsed > 0 {
+		s.speed = float64(s.Downloaded-s.checkpoint) / elapsed
+	}
+	s.checkpoint = s.Downloaded
+	s.checkpointAt = now
+}
+
+// splitSegments divides total bytes into at most count ranges no smaller
+// than minSegmentSize.
+func splitSegments(total, count int) []*fileSegment {
+	if count > total/minSegmentSize {
+		count = total / minSegmentSize
+	}
+	if count < 1 {
+		count = 1
+	}
+	size := total / count
+	segments := make([]*fileSegment, count)
+	for i := range segments {
+		segments[i] = &fileSegment{Start: i * size, End: (i + 1) * size}
+	}
+	segments[count-1].End = total
+	return segments
+}
+
+// makeSegments splits the file in count segments, the segment count of the
+// task. Files without range support or a known size are downloaded as a
+// single segment. f.mu must be held.
+func (f *HttpDownloadFile) makeSegments(count int) {
+	if f.Total == UnknownTotal {
+		// The segment ends at the EOF of the response.
+		f.segments = []*fileSegment{{Start: 0, End: math.MaxInt}}
+		f.partSize = UnknownTotal
+		return
+	}
+	if !f.resumable || f.Total <= 0 {
+		count = 1
+	}
+	f.segments = splitSegments(f.Total, count)
+	f.partSize = f.segments[0].End - f.segments[0].Start
+}
+
+// segmentsCompleted reports whether every byte of the file has been written.
+// f.mu must be held.
+func (f *HttpDownloadFile) segmentsCompleted() bool {
+	for _, s := range f.segments {
+		if s.remaining() > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func (f *HttpDownloadFile) segmentDownloaded(s *fileSegment) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return s.Downloaded
+}
+
+// steal is called when segment done has been downloaded. It splits off the
+// second half of the largest range still being downloaded and returns it as
+// a new segment for the idle connection, or nil when no range is worth
+// splitting.
+func (f *HttpDownloadFile) steal(done *fileSegment) *fileSegment {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	done.active = false
+	done.cancel = nil
+	done.measure(time.Now())
+	if f.status != StatusStarted || !f.resumable {
+		return nil
+	}
+	victim := -1
+	for i, s := range f.segments {
+		if s.active && (victim < 0 || s.remaining() > f.segments[victim].remaining()) {
+			victim = i
+		}
+	}
+	if victim < 0 || f.segments[victim].remaining() < 2*minSegmentSize {
+		return nil
+	}
+	v := f.segments[victim]
+	mid := v.offset() + v.remaining()/2
+	s := &fileSegment{Start: mid, End: v.End, active: true}
+	v.End = mid
+	f.segments = slices.Insert(f.segments, victim+1, s)
+	return s
+}
+
+// takeDropped reports whether the connection of s was dropped for being too
+// slow and the segment should be requested again.
+func (f *HttpDownloadFile) takeDropped(s *fileSegment) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	dropped := s.dropped
+	s.dropped = false
+	s.cancel = nil
+	return dropped && f.status == StatusStarted && s.remaining() > 0
+}
+
+// monitorSegments periodically drops connections that are far slower than
+// the others until stop is closed.
+func (f *HttpDownloadFile) monitorSegments(interval time.Duration, stop chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			f.dropSlowSegments()
+		}
+	}
+}
+
+// dropSlowSegments closes the connections of active segments that are far
+// below the median speed of all segments measured so far, finished ones
+// included, so the range is requested again over a new connection.
+func (f *HttpDownloadFile) dropSlowSegments() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	now := time.Now()
+	var speeds []float64
+	var measured []*fileSegment
+	for _, s := range f.segments {
+		if s.active && s.cancel != nil {
+			// The first interval of a connection includes the time to first byte.
+			if s.fresh {
+				s.fresh = false
+				s.checkpoint = s.Downloaded
+				s.checkpointAt = now
+				continue
+			}
+			s.measure(now)
+			measured = append(measured, s)
+			speeds = append(speeds, s.speed)
+		} else if !s.active && s.speed > 0 {
+			speeds = append(speeds, s.speed)
+		}
+	}
+	if len(speeds) < 2 {
+		return
+	}
+	median := slices.Sorted(slices.Values(speeds))[len(speeds)/2]
+	for _, s := range measured {
+		if s.speed*slowSegmentRatio < median && s.remaining() >= minSegmentSize {
+			s.dropped = true
+			s.cancel()
+			s.cancel = nil
+		}
+	}
+}
+
+// downloadedPrefix returns the length of the data downloaded from the
+// beginning of the file without gaps. f.mu must be held.
+func (f *HttpDownloadFile) downloadedPrefix() int {
+	prefix := 0
+	for _, s := range f.segments {
+		if s.Start > prefix {
+			break
+		}
+		prefix = max(prefix, s.offset())
+		if s.remaining() > 0 {
+			break
+		}
+	}
+	return prefix
+}
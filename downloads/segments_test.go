@@ -0,0 +1,245 @@
+package downloads
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func setMinSegmentSize(t *testing.T, size int) {
+	old := minSegmentSize
+	minSegmentSize = size
+	t.Cleanup(func() { minSegmentSize = old })
+}
+
+func TestSplitSegments(t *testing.T) {
+	setMinSegmentSize(t, 100)
+	segments := splitSegments(1050, 4)
+	if len(segments) != 4 {
+		t.Fatalf("expected 4 segments, got %d", len(segments))
+	}
+	if segments[0].Start != 0 || segments[3].End != 1050 {
+		t.Errorf("segments don't cover the file: %+v", segments)
+	}
+	for i := 1; i < len(segments); i++ {
+		if segments[i].Start != segments[i-1].End {
+			t.Errorf("gap between segments %d and %d", i-1, i)
+		}
+	}
+	if len(splitSegments(250, 4)) != 2 {
+		t.Errorf("segments smaller than minSegmentSize")
+	}
+	if len(splitSegments(50, 4)) != 1 {
+		t.Errorf("small file must be a single segment")
+	}
+}
+
+func TestSegmentedDownload(t *testing.T) {
+	setMinSegmentSize(t, 1000)
+	content := testContent(10000)
+	srv := newTestServer(t, map[string][]byte{"seg.bin": content})
+	dir := t.TempDir()
+
+	task, err := NewHttpDownloadTask(dir, srv.URL+"/seg.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	task.SetSegmentCount(4)
+	if err := task.Start(); err != nil {
+		t.Fatal(err)
+	}
+	waitStatus(t, task, StatusCompleted)
+	assertFile(t, filepath.Join(dir, "seg.bin"), content)
+
+	// Idle connections may steal parts of the others, but every initial range is requested.
+	ranges := srv.rangeRequests()
+	starts := rangeStarts(ranges)
+	for _, start := range []int{2500, 5000, 7500} {
+		if !slices.Contains(starts, start) {
+			t.Errorf("expected request for range starting at %d, got %q", start, ranges)
+		}
+	}
+}
+
+func TestSegmentedResume(t *testing.T) {
+	content := testContent(10000)
+	srv := newTestServer(t, map[string][]byte{"seg.bin": content})
+	dir := t.TempDir()
+
+	partial := make([]byte, 10000)
+	copy(partial[:1000], content[:1000])
+	copy(partial[5000:7000], content[5000:7000])
+	if err := os.WriteFile(filepath.Join(dir, "seg.bin"+partSuffix), partial, 0666); err != nil {
+		t.Fatal(err)
+	}
+	task := restoreHttpDownloadTask(TaskState{
+		Id:       uuid.New(),
+		Type:     DownloadTaskTypeHTTP,
+		Name:     "seg.bin",
+		Path:     dir,
+		Status:   StatusStarted,
+		Segments: 2,
+		Files: []FileState{{
+			Id:         uuid.New(),
+			Name:       "seg.bin",
+			Path:       dir,
+			URL:        srv.URL + "/seg.bin",
+			Downloaded: 3000,
+			Total:      10000,
+			Status:     StatusStarted,
+			Resumable:  true,
+			Segments: []SegmentState{
+				{Start: 0, End: 5000, Downloaded: 1000},
+				{Start: 5000, End: 10000, Downloaded: 2000},
+			},
+		}},
+	})
+	if err := task.Start(); err != nil {
+		t.Fatal(err)
+	}
+	waitStatus(t, task, StatusCompleted)
+	assertFile(t, filepath.Join(dir, "seg.bin"), content)
+
+	ranges := srv.rangeRequests()
+	slices.Sort(ranges)
+	expected := []string{"bytes=1000-4999", "bytes=7000-"}
+	if !slices.Equal(ranges, expected) {
+		t.Errorf("expected requests %q, got %q", expected, ranges)
+	}
+}
+
+// newSlowServer serves content as "/slow.bin" with range support, sleeping
+// delay(start) after every chunk of the response to a range starting at start.
+func newSlowServer(t *testing.T, content []byte, chunk int, delay func(start int) time.Duration) *testServer {
+	t.Helper()
+	srv := &testServer{}
+	srv.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		srv.mu.Lock()
+		srv.requests = append(srv.requests, r)
+		srv.mu.Unlock()
+		start, end := 0, len(content)
+		w.Header().Set("Accept-Ranges", "bytes")
+		w.Header().Set("Content-Disposition", `attachment; filename="slow.bin"`)
+		if rng := r.Header.Get("Range"); rng != "" {
+			fmt.Sscanf(rng, "bytes=%d-%d", &start, &end)
+			if strings.HasSuffix(rng, "-") {
+				end = len(content)
+			} else {
+				end++
+			}
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end-1, len(content)))
+			w.Header().Set("Content-Length", strconv.Itoa(end-start))
+			w.WriteHeader(http.StatusPartialContent)
+		} else {
+			w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+		}
+		if r.Method == http.MethodHead {
+			return
+		}
+		d := delay(start)
+		for pos := start; pos < end; pos += chunk {
+			if _, err := w.Write(content[pos:min(pos+chunk, end)]); err != nil {
+				return
+			}
+			w.(http.Flusher).Flush()
+			select {
+			case <-time.After(d):
+			case <-r.Context().Done():
+				return
+			}
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func rangeStarts(ranges []string) (starts []int) {
+	for _, r := range ranges {
+		start := 0
+		fmt.Sscanf(r, "bytes=%d-", &start)
+		starts = append(starts, start)
+	}
+	return starts
+}
+
+func TestSegmentWorkStealing(t *testing.T) {
+	setMinSegmentSize(t, 1000)
+	content := testContent(40000)
+	srv := newSlowServer(t, content, 1000, func(start int) time.Duration {
+		if start == 20000 {
+			return 20 * time.Millisecond
+		}
+		return 0
+	})
+	dir := t.TempDir()
+
+	task, err := NewHttpDownloadTask(dir, srv.URL+"/slow.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	task.SetSegmentCount(2)
+	if err := task.Start(); err != nil {
+		t.Fatal(err)
+	}
+	waitStatus(t, task, StatusCompleted)
+	assertFile(t, filepath.Join(dir, "slow.bin"), content)
+
+	stolen := false
+	for _, start := range rangeStarts(srv.rangeRequests()) {
+		if start > 20000 {
+			stolen = true
+		}
+	}
+	if !stolen {
+		t.Errorf("the slow range was never split: %q", srv.rangeRequests())
+	}
+}
+
+func TestSlowSegmentDropped(t *testing.T) {
+	setMinSegmentSize(t, 1000)
+	oldInterval := segmentCheckInterval
+	segmentCheckInterval = 50 * time.Millisecond
+	t.Cleanup(func() { segmentCheckInterval = oldInterval })
+
+	content := testContent(40000)
+	// Only the first connection for the second half is slow: 100 bytes every 50ms.
+	var once sync.Once
+	srv := newSlowServer(t, content, 100, func(start int) (d time.Duration) {
+		if start == 20000 {
+			once.Do(func() { d = 50 * time.Millisecond })
+		}
+		return d
+	})
+	dir := t.TempDir()
+
+	task, err := NewHttpDownloadTask(dir, srv.URL+"/slow.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	task.SetSegmentCount(2)
+	if err := task.Start(); err != nil {
+		t.Fatal(err)
+	}
+	waitStatus(t, task, StatusCompleted)
+	assertFile(t, filepath.Join(dir, "slow.bin"), content)
+
+	reconnected := false
+	for _, start := range rangeStarts(srv.rangeRequests()) {
+		if start > 20000 && start < 21000 {
+			reconnected = true
+		}
+	}
+	if !reconnected {
+		t.Errorf("the slow connection was never reopened: %q", srv.rangeRequests())
+	}
+}
@@ -0,0 +1,62 @@
+package downloads
+
+import (
+	"os"
+)
+
+// partSuffix is appended to the name of files while they are downloaded.
+// They get their own name once complete and verified.
+const partSuffix = ".part"
+
+// partName returns the name of the staging file of the file.
+func (f *HttpDownloadFile) partName() string {
+	return f.Name + partSuffix
+}
+
+// staged reports whether the staging file of the file is on disk. The
+// progress of a file without one is lost.
+func (f *HttpDownloadFile) staged() bool {
+	file, err := f.openFile(f.partName(), os.O_RDONLY)
+	if err != nil {
+		return false
+	}
+	file.Close()
+	return true
+}
+
+// commit flushes the staging file of a completed file to disk and renames
+// it to the name of the file, which never holds partial data. f.mu must be
+// held.
+func (f *HttpDownloadFile) commit() error {
+	file := f.file
+	f.file = nil
+	if file == nil {
+		var err error
+		if file, err = f.openFile(f.partName(), os.O_RDWR); err != nil {
+			return err
+		}
+	}
+	err := file.Sync()
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if err := f.renameFile(f.partName(), f.Name); err != nil {
+		return err
+	}
+	syncDir(f.Path)
+	return nil
+}
+
+// syncDir flushes the entries of dir to disk, so renames survive a crash.
+// Platforms that can't sync directories are ignored.
+func syncDir(dir string) {
+	d, err := os.Open(dir)
+	if err != nil {
+		return
+	}
+	d.Sync()
+	d.Close()
+}
@@ -0,0 +1,84 @@
+package downloads
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestStagingFile(t *testing.T) {
+	content := testContent(20000)
+	srv := newSlowServer(t, content, 500, func(int) time.Duration { return 10 * time.Millisecond })
+	dir := t.TempDir()
+	final, part := filepath.Join(dir, "slow.bin"), filepath.Join(dir, "slow.bin"+partSuffix)
+
+	task, err := NewHttpDownloadTask(dir, srv.URL+"/slow.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := task.Start(); err != nil {
+		t.Fatal(err)
+	}
+	waitDownloaded(t, task, 1000)
+	if _, err := os.Stat(final); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("the file must not exist before it is complete: %v", err)
+	}
+	if _, err := os.Stat(part); err != nil {
+		t.Errorf("expected the data in the staging file: %v", err)
+	}
+	waitStatus(t, task, StatusCompleted)
+	assertFile(t, final, content)
+	if _, err := os.Stat(part); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("the staging file must be renamed: %v", err)
+	}
+
+	// Deleting an unfinished task removes its staging file.
+	task, err = NewHttpDownloadTask(dir, srv.URL+"/slow.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := task.Start(); err != nil {
+		t.Fatal(err)
+	}
+	waitDownloaded(t, task, 1000)
+	if err := task.Delete(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "slow (1).bin"+partSuffix)); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Delete must remove the staging file: %v", err)
+	}
+	assertFile(t, final, content)
+}
+
+func TestMissingStagingFileRestarts(t *testing.T) {
+	content := testContent(50000)
+	srv := newTestServer(t, map[string][]byte{"iso.bin": content})
+	dir := t.TempDir()
+	saved := TaskState{
+		Id:     uuid.New(),
+		Type:   DownloadTaskTypeHTTP,
+		Name:   "iso.bin",
+		Path:   dir,
+		Status: StatusStarted,
+		Files: []FileState{{
+			Id:         uuid.New(),
+			Name:       "iso.bin",
+			Path:       dir,
+			URL:        srv.URL + "/iso.bin",
+			Downloaded: 20000,
+			Total:      len(content),
+			Status:     StatusStarted,
+			Resumable:  true,
+		}},
+	}
+	task := loadSaved(t, dir, saved)
+	waitStatus(t, task, StatusCompleted)
+	assertFile(t, filepath.Join(dir, "iso.bin"), content)
+	if ranges := srv.rangeRequests(); len(ranges) != 1 || ranges[0] != "" {
+		t.Errorf("expected the download to start over, got %q", ranges)
+	}
+}
@@ -0,0 +1,134 @@
+package downloads
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+
+	"github.com/google/uuid"
+)
+
+// StateFileName is the name of the state file FileStore keeps in the download directory.
+const StateFileName = ".dls-state.json"
+
+type FileState struct {
+	Id         uuid.UUID      `json:"id"`
+	Name       string         `json:"name"`
+	Path       string         `json:"path"`
+	URL        string         `json:"url"`
+	Downloaded int            `json:"downloaded"`
+	Total      int            `json:"total"`
+	Status     Status         `json:"status"`
+	Error      string         `json:"error,omitempty"`
+	Resumable  bool           `json:"resumable"`
+	Segments   []SegmentState `json:"segments,omitempty"`
+	// Checksum is the expected digest formatted as "algorithm:hexdigest".
+	Checksum         string `json:"checksum,omitempty"`
+	RateLimit        int    `json:"rate_limit,omitempty"`
+	SegmentRateLimit int    `json:"segment_rate_limit,omitempty"`
+	// ETag and LastModified identify the version of the remote file the
+	// downloaded data belongs to.
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"last_modified,omitempty"`
+	// Skipped is set when the file on disk was there before the download
+	// and must not be deleted with it.
+	Skipped bool `json:"skipped,omitempty"`
+}
+
+type TaskState struct {
+	Id            uuid.UUID        `json:"id"`
+	Type          DownloadTaskType `json:"type"`
+	Name          string           `json:"name"`
+	Path          string           `json:"path"`
+	Status        Status           `json:"status"`
+	Error         string           `json:"error,omitempty"`
+	RateLimit     int              `json:"rate_limit"`
+	Weight        int              `json:"weight,omitempty"`
+	ChangePolicy  ChangePolicy     `json:"change_policy,omitempty"`
+	RangeFallback RangeFallback    `json:"range_fallback,omitempty"`
+	Segments      int              `json:"segments"`
+	Files         []FileState      `json:"files"`
+}
+
+// Store keeps task state between process restarts.
+type Store interface {
+	Load() ([]TaskState, error)
+	Save(tasks []TaskState) error
+}
+
+// persistentTask is implemented by tasks that can be written to a Store.
+type persistentTask interface {
+	state() TaskState
+}
+
+// FileStore keeps the state of all tasks in a single JSON file which is
+// replaced atomically on every save.
+type FileStore struct {
+	Path string
+}
+
+func NewFileStore(dir string) *FileStore {
+	return &FileStore{Path: filepath.Join(dir, StateFileName)}
+}
+
+func (s *FileStore) Load() ([]TaskState, error) {
+	data, err := os.ReadFile(s.Path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var tasks []TaskState
+	if err := json.Unmarshal(data, &tasks); err != nil {
+		return nil, err
+	}
+	return tasks, nil
+}
+
+func (s *FileStore) Save(tasks []TaskState) error {
+	data, err := json.MarshalIndent(tasks, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(s.Path), filepath.Base(s.Path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), s.Path)
+}
+
+func errorString(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
+
+func stringError(s string) error {
+	if s == "" {
+		return nil
+	}
+	return errors.New(s)
+}
+
+// restoredStatus maps the status saved by a previous process to the one the
+// task resumes with: anything that was running goes back to the queue.
+func restoredStatus(status Status) Status {
+	if status == StatusStarted {
+		return StatusQueued
+	}
+	return status
+}
@@ -0,0 +1,67 @@
+package downloads
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func TestManagerLoadResumes(t *testing.T) {
+	content := testContent(50000)
+	srv := newTestServer(t, map[string][]byte{"iso.bin": content})
+	dir := t.TempDir()
+
+	// Pretend a previous process died after writing the first 20000 bytes.
+	if err := os.WriteFile(filepath.Join(dir, "iso.bin"+partSuffix), content[:20000], 0666); err != nil {
+		t.Fatal(err)
+	}
+	store := NewFileStore(dir)
+	saved := TaskState{
+		Id:     uuid.New(),
+		Type:   DownloadTaskTypeHTTP,
+		Name:   "iso.bin",
+		Path:   dir,
+		Status: StatusStarted,
+		Files: []FileState{{
+			Id:         uuid.New(),
+			Name:       "iso.bin",
+			Path:       dir,
+			URL:        srv.URL + "/iso.bin",
+			Downloaded: 20000,
+			Total:      50000,
+			Status:     StatusStarted,
+			Resumable:  true,
+		}},
+	}
+	if err := store.Save([]TaskState{saved}); err != nil {
+		t.Fatal(err)
+	}
+
+	m := NewManager(dir, 1)
+	m.SetStore(store)
+	if err := m.Load(); err != nil {
+		t.Fatal(err)
+	}
+	task, err := m.Get(saved.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitStatus(t, task, StatusCompleted)
+	assertFile(t, filepath.Join(dir, "iso.bin"), content)
+	if ranges := srv.rangeRequests(); len(ranges) != 1 || ranges[0] != "bytes=20000-" {
+		t.Errorf("expected a single resume request, got %q", ranges)
+	}
+
+	if err := m.Save(); err != nil {
+		t.Fatal(err)
+	}
+	states, err := store.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(states) != 1 || states[0].Status != StatusCompleted || states[0].Files[0].Downloaded != 50000 {
+		t.Errorf("unexpected saved state %+v", states)
+	}
+}
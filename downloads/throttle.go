@@ -0,0 +1,127 @@
+package downloads
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// hostCooldown is how long the connections to a host stay reduced after it
+// asked us to slow down.
+var hostCooldown = 30 * time.Second
+
+// parseRetryAfter returns the delay asked by a Retry-After header, given
+// either in seconds or as an HTTP date. It returns zero when there's none.
+func parseRetryAfter(h http.Header, now time.Time) time.Duration {
+	v := h.Get("Retry-After")
+	if v == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(v); err == nil {
+		return max(time.Duration(seconds)*time.Second, 0)
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		return max(t.Sub(now), 0)
+	}
+	return 0
+}
+
+// isThrottling reports whether code is a server asking clients to slow down.
+func isThrottling(code int) bool {
+	return code == http.StatusTooManyRequests || code == http.StatusServiceUnavailable
+}
+
+type hostState struct {
+	active int
+	// limit is the number of connections allowed until the throttling ends.
+	limit int
+	until time.Time
+	// changed is closed and replaced whenever a connection is released or
+	// the limit changes.
+	changed chan struct{}
+}
+
+func (s *hostState) allows(now time.Time) bool {
+	return !now.Before(s.until) || s.active < s.limit
+}
+
+func (s *hostState) notify() {
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+// hostThrottle counts the connections open to every host and limits them
+// for a while after a host answers 429 or 503.
+type hostThrottle struct {
+	mu    sync.Mutex
+	hosts map[string]*hostState
+}
+
+// defaultHostThrottle is shared by the tasks which don't belong to a manager.
+var defaultHostThrottle = newHostThrottle()
+
+func newHostThrottle() *hostThrottle {
+	return &hostThrottle{hosts: make(map[string]*hostState)}
+}
+
+func (h *hostThrottle) host(host string) *hostState {
+	s, ok := h.hosts[host]
+	if !ok {
+		s = &hostState{changed: make(chan struct{})}
+		h.hosts[host] = s
+	}
+	return s
+}
+
+// acquire waits until a new connection to host is allowed.
+func (h *hostThrottle) acquire(ctx context.Context, host string) error {
+	for {
+		h.mu.Lock()
+		s := h.host(host)
+		now := time.Now()
+		if s.allows(now) {
+			s.active++
+			h.mu.Unlock()
+			return nil
+		}
+		changed := s.changed
+		timer := time.NewTimer(s.until.Sub(now))
+		h.mu.Unlock()
+		select {
+		case <-changed:
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		}
+		timer.Stop()
+	}
+}
+
+func (h *hostThrottle) release(host string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s := h.host(host)
+	s.active--
+	s.notify()
+}
+
+// throttle halves the connections allowed to host for at least retryAfter
+// and hostCooldown.
+func (h *hostThrottle) throttle(host string, retryAfter time.Duration) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s := h.host(host)
+	now := time.Now()
+	limit := max(s.active/2, 1)
+	if now.Before(s.until) {
+		limit = min(limit, s.limit)
+	}
+	s.limit = limit
+	if until := now.Add(max(retryAfter, hostCooldown)); until.After(s.until) {
+		s.until = until
+	}
+	s.notify()
+}
@@ -0,0 +1,112 @@
+package downloads
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	cases := []struct {
+		value    string
+		expected time.Duration
+	}{
+		{"", 0},
+		{"5", 5 * time.Second},
+		{"-1", 0},
+		{now.Add(time.Minute).Format(http.TimeFormat), time.Minute},
+		{now.Add(-time.Minute).Format(http.TimeFormat), 0},
+		{"soon", 0},
+	}
+	for _, c := range cases {
+		h := http.Header{}
+		if c.value != "" {
+			h.Set("Retry-After", c.value)
+		}
+		if d := parseRetryAfter(h, now); d != c.expected {
+			t.Errorf("%q: expected %s, got %s", c.value, c.expected, d)
+		}
+	}
+}
+
+func TestHostThrottle(t *testing.T) {
+	h := newHostThrottle()
+	ctx := context.Background()
+	for i := 0; i < 4; i++ {
+		if err := h.acquire(ctx, "example.com"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	h.throttle("example.com", 0)
+	if err := h.acquire(ctx, "other.com"); err != nil {
+		t.Errorf("other hosts must not be throttled: %v", err)
+	}
+
+	// Two connections are allowed now: two have to be released before a new one opens.
+	acquired := make(chan error)
+	go func() { acquired <- h.acquire(ctx, "example.com") }()
+	h.release("example.com")
+	h.release("example.com")
+	select {
+	case err := <-acquired:
+		t.Fatalf("acquired a connection over the limit: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	h.release("example.com")
+	select {
+	case err := <-acquired:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("connection was never acquired")
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 20*time.Millisecond)
+	defer cancel()
+	if err := h.acquire(ctx, "example.com"); err == nil {
+		t.Errorf("acquired a connection over the limit")
+	}
+}
+
+func TestRetryAfterDelaysRetry(t *testing.T) {
+	content := testContent(5000)
+	var gets atomic.Int32
+	var retried atomic.Int64
+	start := time.Now()
+	srv := &testServer{}
+	srv.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Disposition", `attachment; filename="busy.bin"`)
+		if r.Method == http.MethodGet {
+			if gets.Add(1) == 1 {
+				w.Header().Set("Retry-After", "1")
+				w.WriteHeader(http.StatusTooManyRequests)
+				return
+			}
+			retried.Store(int64(time.Since(start)))
+		}
+		http.ServeContent(w, r, "busy.bin", time.Time{}, bytes.NewReader(content))
+	}))
+	t.Cleanup(srv.Close)
+	dir := t.TempDir()
+
+	task, err := NewHttpDownloadTask(dir, srv.URL+"/busy.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	task.SetRetryPolicy(&testRetryPolicy)
+	if err := task.Start(); err != nil {
+		t.Fatal(err)
+	}
+	waitStatus(t, task, StatusCompleted)
+	assertFile(t, filepath.Join(dir, "busy.bin"), content)
+	if d := time.Duration(retried.Load()); d < time.Second {
+		t.Errorf("retried after %s, before the delay asked by the server", d)
+	}
+}
@@ -0,0 +1,82 @@
+package downloads
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// ChangePolicy decides what happens when the remote file changes while it
+// is being downloaded.
+type ChangePolicy string
+
+const (
+	// ChangePolicyRestart discards the downloaded data and downloads the
+	// new file from the start.
+	ChangePolicyRestart ChangePolicy = "restart"
+	// ChangePolicyFail fails the file with ErrRemoteChanged.
+	ChangePolicyFail ChangePolicy = "fail"
+)
+
+// ErrRemoteChanged is returned when a resumed download finds that the
+// remote file is not the one its data was downloaded from.
+var ErrRemoteChanged = errors.New("remote file changed")
+
+// ifRange returns the validator to send in the If-Range header of range
+// requests, empty when there is none. Weak ETags can't be used there.
+// f.mu must be held.
+func (f *HttpDownloadFile) ifRange() string {
+	if f.etag != "" && !strings.HasPrefix(f.etag, "W/") {
+		return f.etag
+	}
+	return f.lastModified
+}
+
+// checkUnchanged returns an ErrRemoteChanged error when resp, the response
+// to a range request, comes from another version of the file. f.mu must be
+// held.
+func (f *HttpDownloadFile) checkUnchanged(resp *http.Response) error {
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusPartialContent {
+		return nil
+	}
+	etag, modified := resp.Header.Get("ETag"), resp.Header.Get("Last-Modified")
+	if etag != "" && f.etag != "" && etag != f.etag {
+		return fmt.Errorf("%w: ETag %s instead of %s", ErrRemoteChanged, etag, f.etag)
+	}
+	if modified != "" && f.lastModified != "" && modified != f.lastModified {
+		return fmt.Errorf("%w: modified at %s instead of %s", ErrRemoteChanged, modified, f.lastModified)
+	}
+	if resp.StatusCode == http.StatusPartialContent {
+		if r, err := parseContentRange(resp.Header.Get("Content-Range")); err == nil && f.Total > 0 && r.size != f.Total {
+			return fmt.Errorf("%w: %d bytes instead of %d", ErrRemoteChanged, r.size, f.Total)
+		}
+		return nil
+	}
+	// The server sends the whole file when the If-Range validator doesn't
+	// match. With the same validators, it ignored the range.
+	if f.ifRange() != "" && etag == "" && modified == "" {
+		return fmt.Errorf("%w: the validator %s no longer matches", ErrRemoteChanged, f.ifRange())
+	}
+	if resp.ContentLength >= 0 && f.Total > 0 && int(resp.ContentLength) != f.Total {
+		return fmt.Errorf("%w: %d bytes instead of %d", ErrRemoteChanged, resp.ContentLength, f.Total)
+	}
+	return nil
+}
+
+// SetChangePolicy sets what happens when the remote file of a resumed
+// download changed. The default is ChangePolicyRestart.
+func (dt *HttpDownloadTask) SetChangePolicy(p ChangePolicy) {
+	dt.mu.Lock()
+	defer dt.mu.Unlock()
+	dt.changePolicy = p
+}
+
+func (dt *HttpDownloadTask) GetChangePolicy() ChangePolicy {
+	dt.mu.Lock()
+	defer dt.mu.Unlock()
+	if dt.changePolicy == "" {
+		return ChangePolicyRestart
+	}
+	return dt.changePolicy
+}
@@ -0,0 +1,110 @@
+package downloads
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// resumeVersion restores a download of the first 20000 bytes of old, saved
+// with ETag "v1", from a server now serving content with the given ETag.
+// It returns the task, its directory and the If-Range headers received.
+func resumeVersion(t *testing.T, old, content []byte, etag string, policy ChangePolicy) (DownloadTask, string, func() []string) {
+	t.Helper()
+	var mu sync.Mutex
+	var ifRange []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		ifRange = append(ifRange, r.Header.Get("If-Range"))
+		mu.Unlock()
+		w.Header().Set("ETag", etag)
+		w.Header().Set("Content-Disposition", `attachment; filename="iso.bin"`)
+		http.ServeContent(w, r, "iso.bin", time.Time{}, bytes.NewReader(content))
+	}))
+	t.Cleanup(srv.Close)
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "iso.bin"+partSuffix), old[:20000], 0666); err != nil {
+		t.Fatal(err)
+	}
+	saved := TaskState{
+		Id:           uuid.New(),
+		Type:         DownloadTaskTypeHTTP,
+		Name:         "iso.bin",
+		Path:         dir,
+		Status:       StatusStarted,
+		ChangePolicy: policy,
+		Files: []FileState{{
+			Id:         uuid.New(),
+			Name:       "iso.bin",
+			Path:       dir,
+			URL:        srv.URL + "/iso.bin",
+			Downloaded: 20000,
+			Total:      len(old),
+			Status:     StatusStarted,
+			Resumable:  true,
+			ETag:       `"v1"`,
+		}},
+	}
+	return loadSaved(t, dir, saved), dir, func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string(nil), ifRange...)
+	}
+}
+
+// loadSaved loads saved into a new manager of dir and returns its task.
+func loadSaved(t *testing.T, dir string, saved TaskState) DownloadTask {
+	t.Helper()
+	store := NewFileStore(dir)
+	if err := store.Save([]TaskState{saved}); err != nil {
+		t.Fatal(err)
+	}
+	m := NewManager(dir, 1)
+	t.Cleanup(func() { m.Close() })
+	m.SetStore(store)
+	if err := m.Load(); err != nil {
+		t.Fatal(err)
+	}
+	task, err := m.Get(saved.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return task
+}
+
+func TestResumeUnchanged(t *testing.T) {
+	content := testContent(50000)
+	task, dir, ifRange := resumeVersion(t, content, content, `"v1"`, "")
+	waitStatus(t, task, StatusCompleted)
+	assertFile(t, filepath.Join(dir, "iso.bin"), content)
+	if h := ifRange(); len(h) != 1 || h[0] != `"v1"` {
+		t.Errorf("expected a single request with If-Range, got %q", h)
+	}
+}
+
+func TestResumeChangedRestarts(t *testing.T) {
+	old, content := testContent(50000), bytes.Repeat([]byte("new"), 10000)
+	task, dir, _ := resumeVersion(t, old, content, `"v2"`, ChangePolicyRestart)
+	waitStatus(t, task, StatusCompleted)
+	assertFile(t, filepath.Join(dir, "iso.bin"), content)
+	if task.GetTotal() != len(content) {
+		t.Errorf("expected the size of the new version, got %d", task.GetTotal())
+	}
+}
+
+func TestResumeChangedFails(t *testing.T) {
+	old, content := testContent(50000), bytes.Repeat([]byte("new"), 10000)
+	task, _, _ := resumeVersion(t, old, content, `"v2"`, ChangePolicyFail)
+	waitStatus(t, task, StatusFailed)
+	if !errors.Is(task.GetError(), ErrRemoteChanged) {
+		t.Errorf("expected ErrRemoteChanged, got %v", task.GetError())
+	}
+}
@@ -4,5 +4,6 @@ go 1.24.0
 
 require (
 	github.com/google/uuid v1.6.0
+	golang.org/x/net v0.47.0
 	golang.org/x/time v0.13.0
 )
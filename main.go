@@ -4,6 +4,7 @@ import (
 	"context"
 	"dls/si"
 	"errors"
+	"flag"
 	"fmt"
 	"golang.org/x/time/rate"
 	"io"
@@ -344,6 +345,15 @@ type Downloads struct {
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "probe" {
+		if err := probe(os.Args[2:]); errors.Is(err, flag.ErrHelp) {
+			os.Exit(2)
+		} else if err != nil {
+			fmt.Fprintln(os.Stderr, "dls probe:", err)
+			os.Exit(1)
+		}
+		return
+	}
 	state := NewHttpDownloadState("https://releases.ubuntu.com/24.04.3/ubuntu-24.04.3-desktop-amd64.iso?_gl=1*m3ym8z*_gcl_au*NjQ3NTMwNjYxLjE3NTgwMzExNDk.")
 	//state.downloaded = 133234688
 	//state.resumable = true
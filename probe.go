@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"dls/downloads"
+	"dls/si"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+)
+
+// probe prints how each URL in args would be downloaded, without
+// downloading it.
+func probe(args []string) error {
+	flags := flag.NewFlagSet("probe", flag.ContinueOnError)
+	asJSON := flags.Bool("json", false, "print the results as JSON, one per line")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "usage: dls probe [-json] url...")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() == 0 {
+		flags.Usage()
+		return flag.ErrHelp
+	}
+
+	failed := 0
+	for _, rawURL := range flags.Args() {
+		r, err := downloads.Probe(context.Background(), rawURL)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", rawURL, err)
+			failed++
+			continue
+		}
+		if *asJSON {
+			json.NewEncoder(os.Stdout).Encode(r)
+			continue
+		}
+		size := "unknown"
+		if r.Size != downloads.UnknownTotal {
+			size = fmt.Sprintf("%s (%d bytes)", si.NewBytes(r.Size).String(), r.Size)
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintf(w, "URL:\t%s\n", r.URL)
+		fmt.Fprintf(w, "Name:\t%s\n", r.Name)
+		fmt.Fprintf(w, "Size:\t%s\n", size)
+		fmt.Fprintf(w, "Content-Type:\t%s\n", r.ContentType)
+		fmt.Fprintf(w, "ETag:\t%s\n", r.ETag)
+		fmt.Fprintf(w, "Last-Modified:\t%s\n", r.LastModified)
+		fmt.Fprintf(w, "Checksum:\t%s\n", r.Checksum)
+		fmt.Fprintf(w, "Resumable:\t%t\n", r.Resumable)
+		fmt.Fprintf(w, "Segmented:\t%t\n", r.Segmented)
+		w.Flush()
+		fmt.Println()
+	}
+	if failed > 0 {
+		return fmt.Errorf("failed to probe %d of %d urls", failed, flags.NArg())
+	}
+	return nil
+}